@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// reportProblems prints every configuration problem, one per line
+func reportProblems(err error) error {
+	if err == nil {
+		fmt.Println("configuration is valid")
+		return nil
+	}
+
+	list := problems(err)
+	for _, problem := range list {
+		fmt.Println("- " + problem)
+	}
+
+	return fmt.Errorf("configuration has %d problem(s)", len(list))
+}
+
+// problems splits joined errors into single problems,
+// each keeping the context of the errors that wrap it
+func problems(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var list []string
+		for _, inner := range joined.Unwrap() {
+			list = append(list, problems(inner)...)
+		}
+		return list
+	}
+
+	inner := errors.Unwrap(err)
+	if inner == nil {
+		return []string{err.Error()}
+	}
+
+	prefix, found := strings.CutSuffix(err.Error(), inner.Error())
+	if !found {
+		return []string{err.Error()}
+	}
+
+	list := problems(inner)
+	for i := range list {
+		list[i] = prefix + list[i]
+	}
+
+	return list
+}
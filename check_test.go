@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func TestProblems(t *testing.T) {
+	err := errors.Join(
+		fmt.Errorf("failed to parse hosts: %w", errors.New("bad entry")),
+		fmt.Errorf("failed to initialize connection handler: %w",
+			fmt.Errorf("failed to initialize upstream: %w", errors.Join(
+				errors.New("address is empty"),
+				errors.New("uuid: invalid UUID"),
+			)),
+		),
+	)
+
+	want := []string{
+		"failed to parse hosts: bad entry",
+		"failed to initialize connection handler: failed to initialize upstream: address is empty",
+		"failed to initialize connection handler: failed to initialize upstream: uuid: invalid UUID",
+	}
+
+	if got := problems(err); !slices.Equal(got, want) {
+		t.Errorf("got %q, want: %q", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	t.Setenv("LISTEN_ADDRESS", "127.0.0.1:8443")
+	t.Setenv("UPSTREAM_TYPE", "wireguard")
+	t.Setenv("WIREGUARD_PRIVATE_KEY", key)
+	t.Setenv("WIREGUARD_PUBLIC_KEY", key)
+	t.Setenv("WIREGUARD_ENDPOINT", "wg.example.com:51820")
+	t.Setenv("WIREGUARD_TUNNEL_IP", "10.0.0.2")
+	t.Setenv("WIREGUARD_ALLOWED_IPS", "0.0.0.0/0")
+
+	var cfg config.Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wireguard device is validated, not brought up
+	if err := check(cfg); err != nil {
+		t.Fatalf("check() error: %v", err)
+	}
+
+	// problems of the components and of the upstream are listed together
+	cfg.Hosts = []string{"example.com"}
+	cfg.ProxyConfig.WireguardConfig.PrivateKey = ""
+
+	list := problems(check(cfg))
+	if len(list) != 2 ||
+		!strings.HasPrefix(list[0], "failed to parse hosts: ") ||
+		!strings.HasPrefix(list[1], "invalid connection handler: invalid upstream: private key: ") {
+		t.Errorf("got %q, want a hosts and an upstream problem", list)
+	}
+}
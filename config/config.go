@@ -7,16 +7,52 @@ type Config struct {
 	ListenAddress      string        `envconfig:"LISTEN_ADDRESS" default:":443"`
 	ClientHelloTimeout time.Duration `envconfig:"CLIENT_HELLO_TIMEOUT" default:"5s"`
 	LogLevel           string        `envconfig:"LOG_LEVEL" default:"info"`
+	Hosts              []string      `envconfig:"HOSTS"`
+	ECHRules           []string      `envconfig:"ECH_RULES"`
+	InboundConfig      InboundConfig
+	FallbackConfig     FallbackConfig
+	DialerConfig       DialerConfig
+	ResolverConfig     ResolverConfig
+	PolicyConfig       PolicyConfig
+	OutboundConfig     OutboundConfig
 	ProxyConfig        ProxyConfig
 	BypassConfig       BypassConfig
 }
 
+type InboundConfig struct {
+	Type      InboundType `envconfig:"INBOUND" default:"listen"`
+	TUNConfig TUNConfig
+}
+
+type TUNConfig struct {
+	Name string `envconfig:"TUN_NAME" default:"sni-proxy"`
+	FD   int    `envconfig:"TUN_FD"`
+	MTU  int    `envconfig:"TUN_MTU" default:"1500"`
+}
+
+// FallbackConfig routes connections without sni, a route is host:port, original or reject,
+// the routes of the detected protocols default to the target
+type FallbackConfig struct {
+	Target string `envconfig:"FALLBACK_TARGET" default:"original"`
+	TLS    string `envconfig:"FALLBACK_TLS"`
+	SSH    string `envconfig:"FALLBACK_SSH"`
+	HTTP   string `envconfig:"FALLBACK_HTTP"`
+	Raw    string `envconfig:"FALLBACK_RAW"`
+	// RawTimeout is how long a client may stay silent before it is routed as raw, 0 waits for the ClientHello timeout
+	RawTimeout time.Duration `envconfig:"FALLBACK_RAW_TIMEOUT" default:"1s"`
+}
+
 type ProxyConfig struct {
 	UpstreamType       UpstreamType  `envconfig:"UPSTREAM_TYPE"`
 	UpstreamTimeout    time.Duration `envconfig:"UPSTREAM_TIMEOUT" default:"5s"`
 	HttpProxyConfig    HttpProxyConfig
+	Hysteria2Config    Hysteria2Config
+	NaiveConfig        NaiveConfig
+	ShadowsocksConfig  ShadowsocksConfig
 	SSHConfig          SSHConfig
+	TrojanConfig       TrojanConfig
 	VLESSRealityConfig VLESSRealityConfig
+	VMessConfig        VMessConfig
 	WireguardConfig    WireguardConfig
 }
 
@@ -26,6 +62,36 @@ type BypassConfig struct {
 	}
 }
 
+type DialerConfig struct {
+	Timeout          time.Duration `envconfig:"DIAL_TIMEOUT" default:"5s"`
+	AttemptDelay     time.Duration `envconfig:"DIAL_ATTEMPT_DELAY" default:"250ms"`
+	FamilyPreference AddressFamily `envconfig:"DIAL_FAMILY_PREFERENCE" default:"ipv6"`
+}
+
+type PolicyConfig struct {
+	AllowPrivate bool     `envconfig:"POLICY_ALLOW_PRIVATE" default:"false"`
+	Allow        []string `envconfig:"POLICY_ALLOW_CIDRS"`
+	Deny         []string `envconfig:"POLICY_DENY_CIDRS"`
+}
+
+type OutboundConfig struct {
+	Interface       string   `envconfig:"OUTBOUND_INTERFACE"`
+	SourceAddresses []string `envconfig:"OUTBOUND_SOURCE_ADDRESSES"`
+	Mark            uint32   `envconfig:"OUTBOUND_MARK"`
+}
+
+type ResolverConfig struct {
+	Servers    []string      `envconfig:"DNS_SERVER" default:"tls://1.1.1.1:853"`
+	ServerName string        `envconfig:"DNS_SERVER_NAME"`
+	Timeout    time.Duration `envconfig:"DNS_TIMEOUT" default:"5s"`
+	Cache      struct {
+		Size        int           `envconfig:"DNS_CACHE_SIZE" default:"4096"`
+		MinTTL      time.Duration `envconfig:"DNS_CACHE_MIN_TTL" default:"10s"`
+		MaxTTL      time.Duration `envconfig:"DNS_CACHE_MAX_TTL" default:"1h"`
+		NegativeTTL time.Duration `envconfig:"DNS_CACHE_NEGATIVE_TTL" default:"30s"`
+	}
+}
+
 type (
 	HttpProxyConfig struct {
 		Address  string `envconfig:"HTTP_PROXY_ADDRESS"`
@@ -33,29 +99,114 @@ type (
 		Password string `envconfig:"HTTP_PROXY_PASSWORD"`
 	}
 
+	Hysteria2Config struct {
+		Address      string `envconfig:"HYSTERIA2_ADDRESS"`
+		Password     string `envconfig:"HYSTERIA2_PASSWORD"`
+		ServerName   string `envconfig:"HYSTERIA2_SERVER_NAME"`
+		PinSHA256    string `envconfig:"HYSTERIA2_PIN_SHA256"`
+		ObfsPassword string `envconfig:"HYSTERIA2_OBFS_PASSWORD"`
+	}
+
+	NaiveConfig struct {
+		Address     string `envconfig:"NAIVE_ADDRESS"`
+		Username    string `envconfig:"NAIVE_USERNAME"`
+		Password    string `envconfig:"NAIVE_PASSWORD"`
+		ServerName  string `envconfig:"NAIVE_SERVER_NAME"`
+		Fingerprint string `envconfig:"NAIVE_FINGERPRINT" default:"chrome"`
+		Padding     bool   `envconfig:"NAIVE_PADDING" default:"true"`
+	}
+
+	ShadowsocksConfig struct {
+		URL      string `envconfig:"SHADOWSOCKS_URL"`
+		Address  string `envconfig:"SHADOWSOCKS_ADDRESS"`
+		Method   string `envconfig:"SHADOWSOCKS_METHOD"`
+		Password string `envconfig:"SHADOWSOCKS_PASSWORD"`
+	}
+
 	SSHConfig struct {
 		Address    string `envconfig:"SSH_ADDRESS"`
 		User       string `envconfig:"SSH_USER"`
 		PrivateKey string `envconfig:"SSH_PRIVATE_KEY"`
 	}
 
+	TrojanConfig struct {
+		Address     string   `envconfig:"TROJAN_ADDRESS"`
+		Password    string   `envconfig:"TROJAN_PASSWORD"`
+		ServerName  string   `envconfig:"TROJAN_SERVER_NAME"`
+		Fingerprint string   `envconfig:"TROJAN_FINGERPRINT"`
+		ALPN        []string `envconfig:"TROJAN_ALPN"`
+	}
+
 	VLESSRealityConfig struct {
-		Address     string `envconfig:"VLESS_REALITY_ADDRESS"`
-		UUID        string `envconfig:"VLESS_REALITY_UUID"`
-		ShortID     string `envconfig:"VLESS_REALITY_SHORTID"`
-		PublicKey   string `envconfig:"VLESS_REALITY_PUBLIC_KEY"`
-		ServerName  string `envconfig:"VLESS_REALITY_SERVER_NAME"`
-		Fingerprint string `envconfig:"VLESS_REALITY_FINGERPRINT"`
+		URL          string `envconfig:"VLESS_REALITY_URL"`
+		Subscription string `envconfig:"VLESS_REALITY_SUBSCRIPTION"`
+		Address      string `envconfig:"VLESS_REALITY_ADDRESS"`
+		UUID         string `envconfig:"VLESS_REALITY_UUID"`
+		ShortID      string `envconfig:"VLESS_REALITY_SHORTID"`
+		PublicKey    string `envconfig:"VLESS_REALITY_PUBLIC_KEY"`
+		ServerName   string `envconfig:"VLESS_REALITY_SERVER_NAME"`
+		Fingerprint  string `envconfig:"VLESS_REALITY_FINGERPRINT"`
+		Flow         string `envconfig:"VLESS_REALITY_FLOW"`
+
+		Security  VLESSSecurity  `envconfig:"VLESS_REALITY_SECURITY" default:"reality"`
+		Transport VLESSTransport `envconfig:"VLESS_REALITY_TRANSPORT" default:"tcp"`
+		ALPN      []string       `envconfig:"VLESS_REALITY_ALPN"`
+		Host      string         `envconfig:"VLESS_REALITY_HOST"`
+		Path      string         `envconfig:"VLESS_REALITY_PATH"`
+		Mode      string         `envconfig:"VLESS_REALITY_MODE"`
+
+		Mux struct {
+			Concurrency uint32        `envconfig:"VLESS_REALITY_MUX_CONCURRENCY" default:"0"`
+			MaxReuse    uint32        `envconfig:"VLESS_REALITY_MUX_MAX_REUSE" default:"128"`
+			MaxLifetime time.Duration `envconfig:"VLESS_REALITY_MUX_MAX_LIFETIME" default:"0"`
+			IdleTimeout time.Duration `envconfig:"VLESS_REALITY_MUX_IDLE_TIMEOUT" default:"16s"`
+		}
+	}
+
+	VMessConfig struct {
+		Address     string        `envconfig:"VMESS_ADDRESS"`
+		UUID        string        `envconfig:"VMESS_UUID"`
+		Security    VMessSecurity `envconfig:"VMESS_SECURITY" default:"auto"`
+		TLS         bool          `envconfig:"VMESS_TLS"`
+		ServerName  string        `envconfig:"VMESS_SERVER_NAME"`
+		Fingerprint string        `envconfig:"VMESS_FINGERPRINT"`
+		ALPN        []string      `envconfig:"VMESS_ALPN"`
 	}
 
 	WireguardConfig struct {
-		Endpoint          string `envconfig:"WIREGUARD_ENDPOINT"`
-		PrivateKey        string `envconfig:"WIREGUARD_PRIVATE_KEY"`
-		PublicKey         string `envconfig:"WIREGUARD_PUBLIC_KEY"`
-		PresharedKey      string `envconfig:"WIREGUARD_PRESHARED_KEY"`
-		TunnelIP          string `envconfig:"WIREGUARD_TUNNEL_IP"`
-		DNS               string `envconfig:"WIREGUARD_DNS"`
-		MTU               int    `envconfig:"WIREGUARD_MTU"`
-		KeepaliveInterval int    `envconfig:"WIREGUARD_KEEPALIVE_INTERVAL"`
+		Config              string        `envconfig:"WIREGUARD_CONFIG"`
+		Endpoint            string        `envconfig:"WIREGUARD_ENDPOINT"`
+		PrivateKey          string        `envconfig:"WIREGUARD_PRIVATE_KEY"`
+		PublicKey           string        `envconfig:"WIREGUARD_PUBLIC_KEY"`
+		PresharedKey        string        `envconfig:"WIREGUARD_PRESHARED_KEY"`
+		TunnelIP            []string      `envconfig:"WIREGUARD_TUNNEL_IP"`
+		AllowedIPs          []string      `envconfig:"WIREGUARD_ALLOWED_IPS"`
+		DNS                 []string      `envconfig:"WIREGUARD_DNS"`
+		MTU                 int           `envconfig:"WIREGUARD_MTU"`
+		KeepaliveInterval   int           `envconfig:"WIREGUARD_KEEPALIVE_INTERVAL"`
+		HealthCheckInterval time.Duration `envconfig:"WIREGUARD_HEALTH_CHECK_INTERVAL" default:"10s"`
+
+		// udp datagrams over a stream for networks that block udp
+		Transport   WireguardTransport `envconfig:"WIREGUARD_TRANSPORT" default:"udp"`
+		TLS         bool               `envconfig:"WIREGUARD_TLS"`
+		ServerName  string             `envconfig:"WIREGUARD_SERVER_NAME"`
+		Fingerprint string             `envconfig:"WIREGUARD_FINGERPRINT"`
+		Path        string             `envconfig:"WIREGUARD_WS_PATH" default:"/"`
+
+		// lookups of destination names, always sent through the tunnel
+		DNSServerName string        `envconfig:"WIREGUARD_DNS_SERVER_NAME"`
+		DNSTimeout    time.Duration `envconfig:"WIREGUARD_DNS_TIMEOUT" default:"5s"`
+		DNSCacheSize  int           `envconfig:"WIREGUARD_DNS_CACHE_SIZE" default:"4096"`
+
+		// amneziawg obfuscation
+		Jc   int    `envconfig:"WIREGUARD_JC"`
+		Jmin int    `envconfig:"WIREGUARD_JMIN"`
+		Jmax int    `envconfig:"WIREGUARD_JMAX"`
+		S1   int    `envconfig:"WIREGUARD_S1"`
+		S2   int    `envconfig:"WIREGUARD_S2"`
+		H1   uint32 `envconfig:"WIREGUARD_H1"`
+		H2   uint32 `envconfig:"WIREGUARD_H2"`
+		H3   uint32 `envconfig:"WIREGUARD_H3"`
+		H4   uint32 `envconfig:"WIREGUARD_H4"`
 	}
 )
@@ -5,13 +5,68 @@ type Mode string
 const (
 	ModeProxy  Mode = "proxy"
 	ModeBypass Mode = "bypass"
+	ModeDirect Mode = "direct"
+)
+
+type InboundType string
+
+const (
+	InboundTypeListen   InboundType = "listen"
+	InboundTypeTUN      InboundType = "tun"
+	InboundTypeRedirect InboundType = "redirect"
+	InboundTypeTProxy   InboundType = "tproxy"
 )
 
 type UpstreamType string
 
 const (
 	UpstreamTypeHttpProxy    UpstreamType = "http-proxy"
+	UpstreamTypeHysteria2    UpstreamType = "hysteria2"
+	UpstreamTypeNaive        UpstreamType = "naive"
+	UpstreamTypeShadowsocks  UpstreamType = "shadowsocks"
 	UpstreamTypeSSH          UpstreamType = "ssh"
+	UpstreamTypeTrojan       UpstreamType = "trojan"
 	UpstreamTypeVLESSReality UpstreamType = "vless-reality"
+	UpstreamTypeVMess        UpstreamType = "vmess"
 	UpstreamTypeWireguard    UpstreamType = "wireguard"
 )
+
+type AddressFamily string
+
+const (
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
+type VLESSSecurity string
+
+const (
+	VLESSSecurityReality VLESSSecurity = "reality"
+	VLESSSecurityTLS     VLESSSecurity = "tls"
+)
+
+type VLESSTransport string
+
+const (
+	VLESSTransportTCP       VLESSTransport = "tcp"
+	VLESSTransportWebSocket VLESSTransport = "ws"
+	VLESSTransportGRPC      VLESSTransport = "grpc"
+	VLESSTransportXHTTP     VLESSTransport = "xhttp"
+)
+
+type VMessSecurity string
+
+const (
+	VMessSecurityAuto             VMessSecurity = "auto"
+	VMessSecurityAES128GCM        VMessSecurity = "aes-128-gcm"
+	VMessSecurityChacha20Poly1305 VMessSecurity = "chacha20-poly1305"
+	VMessSecurityNone             VMessSecurity = "none"
+)
+
+type WireguardTransport string
+
+const (
+	WireguardTransportUDP       WireguardTransport = "udp"
+	WireguardTransportTCP       WireguardTransport = "tcp"
+	WireguardTransportWebSocket WireguardTransport = "ws"
+)
@@ -0,0 +1,182 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// Dialer resolves hosts and connects to one of their addresses using
+// Happy Eyeballs (RFC 8305)
+type Dialer struct {
+	config   config.DialerConfig
+	resolver *Resolver
+	hosts    *Hosts
+	policy   *Policy
+	outbound *Outbound
+}
+
+func New(config config.DialerConfig, resolver *Resolver, hosts *Hosts, policy *Policy, outbound *Outbound) *Dialer {
+	return &Dialer{
+		config:   config,
+		resolver: resolver,
+		hosts:    hosts,
+		policy:   policy,
+		outbound: outbound,
+	}
+}
+
+// Init validates the address family preference
+func (d *Dialer) Init() error {
+	switch d.config.FamilyPreference {
+	case config.AddressFamilyIPv4, config.AddressFamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("unsupported address family preference: %q, expected %s or %s",
+			d.config.FamilyPreference, config.AddressFamilyIPv4, config.AddressFamilyIPv6)
+	}
+}
+
+// Dial resolves host and connects to one of its addresses,
+// static host overrides take precedence over dns
+func (d *Dialer) Dial(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	if err := d.policy.CheckHost(host, port); err != nil {
+		return nil, err
+	}
+
+	if target, ok := d.hosts.Lookup(host); ok {
+		if len(target.Addrs) > 0 {
+			return d.DialAddrs(ctx, target.Addrs, port)
+		}
+		host = target.Host
+	}
+
+	addrs, err := d.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.DialAddrs(ctx, addrs, port)
+}
+
+// DialAddrs races staggered connection attempts to addrs and returns the first
+// connection that succeeds, addresses denied by the policy are skipped
+func (d *Dialer) DialAddrs(ctx context.Context, addrs []netip.Addr, port uint16) (net.Conn, error) {
+	var (
+		allowed []netip.Addr
+		denied  []error
+	)
+
+	for _, addr := range addrs {
+		if err := d.policy.CheckAddr(addr, port); err != nil {
+			denied = append(denied, err)
+			continue
+		}
+		allowed = append(allowed, addr)
+	}
+
+	if len(denied) > 0 && len(allowed) == 0 {
+		return nil, errors.Join(denied...)
+	}
+
+	addrs = d.sortAddrs(allowed)
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan result)
+
+	attempt := func(addr netip.AddrPort) {
+		conn, err := d.outbound.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			err = fmt.Errorf("dial %s: %w", addr, err)
+		}
+
+		select {
+		case results <- result{conn: conn, err: err}:
+		case <-ctx.Done():
+			// another attempt won or the deadline passed
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	var (
+		next    int
+		pending int
+		errs    []error
+		timer   = time.NewTimer(0)
+	)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			go attempt(netip.AddrPortFrom(addrs[next], port))
+			next++
+			pending++
+
+			if next < len(addrs) {
+				timer.Reset(d.config.AttemptDelay)
+			}
+		case res := <-results:
+			pending--
+
+			if res.err == nil {
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+
+			if next < len(addrs) {
+				// don't wait for the delay once an attempt has failed
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			return nil, errors.Join(append(errs, ctx.Err())...)
+		}
+	}
+}
+
+// sortAddrs interleaves address families starting with the preferred one
+func (d *Dialer) sortAddrs(addrs []netip.Addr) []netip.Addr {
+	var preferred, other []netip.Addr
+
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+
+		if addr.Is6() == (d.config.FamilyPreference != config.AddressFamilyIPv4) {
+			preferred = append(preferred, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+
+	sorted := make([]netip.Addr, 0, len(addrs))
+
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			sorted = append(sorted, preferred[i])
+		}
+		if i < len(other) {
+			sorted = append(sorted, other[i])
+		}
+	}
+
+	return sorted
+}
@@ -0,0 +1,95 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func TestSortAddrs(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+
+	tests := []struct {
+		preference config.AddressFamily
+		want       []string
+	}{
+		{
+			preference: config.AddressFamilyIPv6,
+			want:       []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		},
+		{
+			preference: config.AddressFamilyIPv4,
+			want:       []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"},
+		},
+	}
+
+	for _, tt := range tests {
+		d := New(config.DialerConfig{FamilyPreference: tt.preference}, nil, nil, nil, nil)
+
+		var got []string
+		for _, addr := range d.sortAddrs(addrs) {
+			got = append(got, addr.String())
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want: %v", tt.preference, got, tt.want)
+		}
+	}
+}
+
+func TestDialerInit(t *testing.T) {
+	for _, preference := range []config.AddressFamily{config.AddressFamilyIPv4, config.AddressFamilyIPv6} {
+		if err := New(config.DialerConfig{FamilyPreference: preference}, nil, nil, nil, nil).Init(); err != nil {
+			t.Errorf("%s: Init() error: %v", preference, err)
+		}
+	}
+
+	for _, preference := range []config.AddressFamily{"v4", "IPv6", ""} {
+		if err := New(config.DialerConfig{FamilyPreference: preference}, nil, nil, nil, nil).Init(); err == nil {
+			t.Errorf("%q: expected error", preference)
+		}
+	}
+}
+
+func TestDialAddrsSkipsDeadAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	listenAddr := netip.MustParseAddrPort(ln.Addr().String())
+
+	d := New(config.DialerConfig{
+		Timeout:          time.Second,
+		AttemptDelay:     250 * time.Millisecond,
+		FamilyPreference: config.AddressFamilyIPv4,
+	}, nil, nil, NewPolicy(config.PolicyConfig{AllowPrivate: true}, "127.0.0.1:0"), NewOutbound(config.OutboundConfig{}))
+
+	// nothing listens on 127.0.0.2, so the first attempt is refused
+	addrs := []netip.Addr{
+		netip.MustParseAddr("127.0.0.2"),
+		listenAddr.Addr(),
+	}
+
+	conn, err := d.DialAddrs(context.Background(), addrs, listenAddr.Port())
+	if err != nil {
+		t.Fatalf("DialAddrs() error: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != listenAddr.String() {
+		t.Errorf("got %s, want: %s", got, listenAddr)
+	}
+}
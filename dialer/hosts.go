@@ -0,0 +1,110 @@
+package dialer
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Hosts is a static table of host overrides, consulted before dns.
+// It only changes where connections go, the ClientHello keeps the original sni
+type Hosts struct {
+	config  []string
+	entries []hostsEntry
+}
+
+type hostsEntry struct {
+	pattern string
+	target  HostsTarget
+}
+
+// HostsTarget is either a list of addresses or another hostname
+type HostsTarget struct {
+	Addrs []netip.Addr
+	Host  string
+}
+
+func NewHosts(config []string) *Hosts {
+	return &Hosts{config: config}
+}
+
+// Init parses entries in the form "pattern=ip[;ip...]" or "pattern=hostname".
+// A pattern is either an exact name or "*.domain" matching any subdomain
+func (h *Hosts) Init() error {
+	for _, entry := range h.config {
+		pattern, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || pattern == "" || value == "" {
+			return fmt.Errorf("invalid hosts entry %q, expected pattern=target", entry)
+		}
+
+		// "*example.com" would also match badexample.com
+		if strings.Contains(pattern, "*") && (!strings.HasPrefix(pattern, "*.") || strings.Count(pattern, "*") > 1 || len(pattern) == 2) {
+			return fmt.Errorf("invalid hosts entry %q, a wildcard pattern has the form *.domain", entry)
+		}
+
+		var target HostsTarget
+
+		for item := range strings.SplitSeq(value, ";") {
+			if item == "" {
+				continue
+			}
+
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				if target.Host != "" || len(target.Addrs) > 0 {
+					return fmt.Errorf("invalid hosts entry %q, expected addresses or a single hostname", entry)
+				}
+				target.Host = item
+				continue
+			}
+
+			if target.Host != "" {
+				return fmt.Errorf("invalid hosts entry %q, expected addresses or a single hostname", entry)
+			}
+			target.Addrs = append(target.Addrs, addr)
+		}
+
+		if target.Host == "" && len(target.Addrs) == 0 {
+			return fmt.Errorf("invalid hosts entry %q, target is empty", entry)
+		}
+
+		h.entries = append(h.entries, hostsEntry{
+			pattern: strings.ToLower(pattern),
+			target:  target,
+		})
+	}
+
+	return nil
+}
+
+// Lookup returns the target of the first entry matching host
+func (h *Hosts) Lookup(host string) (HostsTarget, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, entry := range h.entries {
+		if suffix, ok := strings.CutPrefix(entry.pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return entry.target, true
+			}
+		} else if host == entry.pattern {
+			return entry.target, true
+		}
+	}
+
+	return HostsTarget{}, false
+}
+
+// Target returns a single host to connect to instead of host, to be used
+// by upstreams that accept only one destination
+func (h *Hosts) Target(host string) string {
+	target, ok := h.Lookup(host)
+	if !ok {
+		return host
+	}
+
+	if len(target.Addrs) > 0 {
+		return target.Addrs[0].String()
+	}
+
+	return target.Host
+}
@@ -0,0 +1,56 @@
+package dialer
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+	hosts := NewHosts([]string{
+		"*.googlevideo.com=203.0.113.10;2001:db8::10",
+		"Example.com=edge.example.net",
+		"*.example.com=198.51.100.1",
+	})
+	if err := hosts.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		host   string
+		addrs  []netip.Addr
+		target string
+		ok     bool
+	}{
+		{"rr1.googlevideo.com", []netip.Addr{netip.MustParseAddr("203.0.113.10"), netip.MustParseAddr("2001:db8::10")}, "203.0.113.10", true},
+		{"example.com.", nil, "edge.example.net", true},
+		{"www.example.com", []netip.Addr{netip.MustParseAddr("198.51.100.1")}, "198.51.100.1", true},
+		{"googlevideo.com", nil, "googlevideo.com", false},
+		{"badexample.com", nil, "badexample.com", false},
+	} {
+		target, ok := hosts.Lookup(tc.host)
+		if ok != tc.ok || !slices.Equal(target.Addrs, tc.addrs) {
+			t.Errorf("%s: got %+v %v, want: %v %v", tc.host, target, ok, tc.addrs, tc.ok)
+		}
+		if got := hosts.Target(tc.host); got != tc.target {
+			t.Errorf("%s: got target %s, want: %s", tc.host, got, tc.target)
+		}
+	}
+}
+
+func TestHostsInvalid(t *testing.T) {
+	for _, entry := range []string{
+		"example.com",
+		"=192.0.2.1",
+		"example.com=",
+		"example.com=192.0.2.1;edge.example.net",
+		"example.com=edge.example.net;other.example.net",
+		"*example.com=192.0.2.1",
+		"*.=192.0.2.1",
+		"a.*.example.com=192.0.2.1",
+	} {
+		if err := NewHosts([]string{entry}).Init(); err == nil {
+			t.Errorf("%q: expected error", entry)
+		}
+	}
+}
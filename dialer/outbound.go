@@ -0,0 +1,81 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// Outbound applies socket options to every outgoing tcp connection:
+// the interface to bind to, the source address and the firewall mark
+type Outbound struct {
+	config config.OutboundConfig
+
+	sourceIPv4 netip.Addr
+	sourceIPv6 netip.Addr
+}
+
+func NewOutbound(config config.OutboundConfig) *Outbound {
+	return &Outbound{config: config}
+}
+
+func (o *Outbound) Init() error {
+	for _, source := range o.config.SourceAddresses {
+		addr, err := netip.ParseAddr(source)
+		if err != nil {
+			return fmt.Errorf("source address %q: %w", source, err)
+		}
+
+		addr = addr.Unmap()
+
+		if addr.Is4() {
+			o.sourceIPv4 = addr
+		} else {
+			o.sourceIPv6 = addr
+		}
+	}
+
+	return o.validate()
+}
+
+// Mark returns the firewall mark for sockets that are not created by Dialer
+func (o *Outbound) Mark() uint32 {
+	return o.config.Mark
+}
+
+// Dialer returns a dialer that applies the outbound options
+func (o *Outbound) Dialer() *net.Dialer {
+	return &net.Dialer{Control: o.control}
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return o.Dialer().DialContext(ctx, network, address)
+}
+
+func (o *Outbound) control(_, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	// only bind a source address of the same family as the destination
+	source := o.sourceIPv4
+	if addrPort.Addr().Unmap().Is6() {
+		source = o.sourceIPv6
+	}
+
+	var controlErr error
+
+	err = c.Control(func(fd uintptr) {
+		controlErr = o.setSockopts(fd, source)
+	})
+	if err != nil {
+		return err
+	}
+
+	return controlErr
+}
@@ -0,0 +1,42 @@
+package dialer
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+func (*Outbound) validate() error {
+	return nil
+}
+
+func (o *Outbound) setSockopts(fd uintptr, source netip.Addr) error {
+	if o.config.Interface != "" {
+		if err := unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, o.config.Interface); err != nil {
+			return fmt.Errorf("failed to bind to interface %s: %w", o.config.Interface, err)
+		}
+	}
+
+	if o.config.Mark != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.config.Mark)); err != nil {
+			return fmt.Errorf("failed to set mark: %w", err)
+		}
+	}
+
+	if source.IsValid() {
+		var sa unix.Sockaddr
+
+		if source.Is4() {
+			sa = &unix.SockaddrInet4{Addr: source.As4()}
+		} else {
+			sa = &unix.SockaddrInet6{Addr: source.As16()}
+		}
+
+		if err := unix.Bind(int(fd), sa); err != nil {
+			return fmt.Errorf("failed to bind to source address %s: %w", source, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package dialer
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func (o *Outbound) validate() error {
+	if o.config.Interface != "" || o.config.Mark != 0 || len(o.config.SourceAddresses) > 0 {
+		return errors.New("outbound options are only supported on linux")
+	}
+
+	return nil
+}
+
+func (*Outbound) setSockopts(_ uintptr, _ netip.Addr) error {
+	return nil
+}
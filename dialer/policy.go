@@ -0,0 +1,173 @@
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+var (
+	errDestinationDenied = errors.New("destination denied by policy")
+	errSelfLoop          = errors.New("destination is the proxy itself")
+)
+
+// prefixes that are never reachable from the outside, blocked unless allowed explicitly
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// name suffixes that only make sense on the local network
+var privateSuffixes = []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"}
+
+// Policy decides which destinations the proxy is allowed to connect to
+type Policy struct {
+	config        config.PolicyConfig
+	listenAddress string
+
+	allow      []netip.Prefix
+	deny       []netip.Prefix
+	listenPort uint16
+	localAddrs map[netip.Addr]struct{}
+}
+
+func NewPolicy(config config.PolicyConfig, listenAddress string) *Policy {
+	return &Policy{
+		config:        config,
+		listenAddress: listenAddress,
+	}
+}
+
+func (p *Policy) Init() error {
+	var err error
+
+	if p.allow, err = parsePrefixes(p.config.Allow); err != nil {
+		return fmt.Errorf("allow list: %w", err)
+	}
+
+	if p.deny, err = parsePrefixes(p.config.Deny); err != nil {
+		return fmt.Errorf("deny list: %w", err)
+	}
+
+	listenHost, listenPort, err := net.SplitHostPort(p.listenAddress)
+	if err != nil {
+		return fmt.Errorf("listen address %q: %w", p.listenAddress, err)
+	}
+
+	port, err := net.LookupPort("tcp", listenPort)
+	if err != nil {
+		return fmt.Errorf("listen port %q: %w", listenPort, err)
+	}
+	p.listenPort = uint16(port)
+
+	// collect the addresses the listener can be reached at
+	p.localAddrs = make(map[netip.Addr]struct{})
+
+	listenAddr, err := netip.ParseAddr(listenHost)
+	if err == nil && !listenAddr.IsUnspecified() {
+		p.localAddrs[listenAddr.Unmap()] = struct{}{}
+		return nil
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+
+	for _, ifaceAddr := range ifaceAddrs {
+		prefix, err := netip.ParsePrefix(ifaceAddr.String())
+		if err != nil {
+			continue
+		}
+		p.localAddrs[prefix.Addr().Unmap()] = struct{}{}
+	}
+
+	return nil
+}
+
+// CheckHost rejects names that can only point to the local network,
+// address literals are checked with CheckAddr
+func (p *Policy) CheckHost(host string, port uint16) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.CheckAddr(addr, port)
+	}
+
+	if p.config.AllowPrivate {
+		return nil
+	}
+
+	host = "." + strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, suffix := range privateSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return fmt.Errorf("%s: %w", host[1:], errDestinationDenied)
+		}
+	}
+
+	return nil
+}
+
+// CheckAddr rejects denied, private and self-referencing destinations
+func (p *Policy) CheckAddr(addr netip.Addr, port uint16) error {
+	addr = addr.Unmap()
+
+	if _, ok := p.localAddrs[addr]; ok && port == p.listenPort {
+		return fmt.Errorf("%s: %w", netip.AddrPortFrom(addr, port), errSelfLoop)
+	}
+
+	if containsAddr(p.deny, addr) {
+		return fmt.Errorf("%s: %w", addr, errDestinationDenied)
+	}
+
+	if p.config.AllowPrivate || containsAddr(p.allow, addr) {
+		return nil
+	}
+
+	if containsAddr(privatePrefixes, addr) {
+		return fmt.Errorf("%s: %w", addr, errDestinationDenied)
+	}
+
+	return nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package dialer
+
+import (
+	"testing"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy(config.PolicyConfig{
+		Allow: []string{"10.1.0.0/16"},
+		Deny:  []string{"203.0.113.0/24"},
+	}, "192.0.2.1:443")
+	if err := p.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	tests := []struct {
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{host: "example.com", port: 443, allowed: true},
+		{host: "localhost", port: 443, allowed: false},
+		{host: "metadata.google.internal", port: 443, allowed: false},
+		{host: "198.51.100.1", port: 443, allowed: true},
+		{host: "127.0.0.1", port: 443, allowed: false},
+		{host: "::ffff:192.168.1.1", port: 443, allowed: false},
+		{host: "fe80::1", port: 443, allowed: false},
+		{host: "169.254.169.254", port: 80, allowed: false},
+		{host: "10.1.2.3", port: 443, allowed: true},
+		{host: "10.2.2.3", port: 443, allowed: false},
+		{host: "203.0.113.5", port: 443, allowed: false},
+		{host: "192.0.2.1", port: 443, allowed: false},
+		{host: "192.0.2.1", port: 8443, allowed: true},
+	}
+
+	for _, tt := range tests {
+		err := p.CheckHost(tt.host, tt.port)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: got allowed %t, want: %t (error: %v)", tt.host, allowed, tt.allowed, err)
+		}
+	}
+}
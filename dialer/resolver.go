@@ -0,0 +1,285 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+// DialFunc opens the connections to the DNS servers
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Resolver is a caching stub resolver that talks to the configured DNS servers
+// in order, independent of the system resolver to avoid dns loops
+type Resolver struct {
+	config config.ResolverConfig
+	dial   DialFunc
+
+	transport transport
+	group     singleflight.Group
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+type transport interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// NewResolver returns a resolver that connects to the DNS servers with dial,
+// the servers are given by ip so that dial never needs a lookup
+func NewResolver(config config.ResolverConfig, dial DialFunc) *Resolver {
+	return &Resolver{
+		config: config,
+		dial:   dial,
+		cache:  make(map[cacheKey]cacheEntry),
+	}
+}
+
+func (r *Resolver) Init() error {
+	if len(r.config.Servers) == 0 {
+		return errors.New("no dns server")
+	}
+
+	var (
+		transports fallbackTransport
+		errs       []error
+	)
+
+	for _, server := range r.config.Servers {
+		t, err := r.newTransport(server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dns server %q: %w", server, err))
+			continue
+		}
+		transports = append(transports, t)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	r.transport = transports
+
+	return nil
+}
+
+func (r *Resolver) newTransport(server string) (transport, error) {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverURL.Hostname() == "" {
+		return nil, errors.New("no host")
+	}
+
+	// a name would have to be looked up with the system resolver
+	if _, err = netip.ParseAddr(serverURL.Hostname()); err != nil {
+		return nil, fmt.Errorf("host %s is not an ip address", serverURL.Hostname())
+	}
+
+	serverName := r.config.ServerName
+	if serverName == "" {
+		serverName = serverURL.Hostname()
+	}
+
+	switch serverURL.Scheme {
+	case "udp":
+		return newUDPTransport(hostPort(serverURL, "53"), r.dial), nil
+	case "tcp":
+		return newTCPTransport(hostPort(serverURL, "53"), nil, r.dial), nil
+	case "tls":
+		return newTCPTransport(hostPort(serverURL, "853"), &tls.Config{ServerName: serverName}, r.dial), nil
+	case "https":
+		return newDoHTransport(serverURL, serverName, r.dial), nil
+	default:
+		return nil, fmt.Errorf("unsupported dns server scheme: %q", serverURL.Scheme)
+	}
+}
+
+// hostPort returns the address of a server url, with the default port of its scheme
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// LookupNetIP returns both IPv4 and IPv6 addresses of host
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	var (
+		wg         sync.WaitGroup
+		ipv4, ipv6 []netip.Addr
+		err4, err6 error
+	)
+	wg.Go(func() { ipv4, err4 = r.lookup(ctx, host, dns.TypeA) })
+	wg.Go(func() { ipv6, err6 = r.lookup(ctx, host, dns.TypeAAAA) })
+	wg.Wait()
+
+	addrs := slices.Concat(ipv6, ipv4)
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	if err4 != nil || err6 != nil {
+		return nil, fmt.Errorf("lookup %s: %w", host, errors.Join(err4, err6))
+	}
+
+	return nil, fmt.Errorf("lookup %s: %w", host, errNoSuchHost)
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]netip.Addr, error) {
+	key := cacheKey{name: dns.Fqdn(host), qtype: qtype}
+
+	if addrs, ok := r.cached(key); ok {
+		return addrs, nil
+	}
+
+	// collapse concurrent identical lookups into one query, it is detached from the caller
+	// that started it so a caller giving up does not fail the others
+	results := r.group.DoChan(fmt.Sprintf("%s/%d", key.name, key.qtype), func() (any, error) {
+		queryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.config.Timeout)
+		defer cancel()
+
+		return r.query(queryCtx, key)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		addrs, _ := result.Val.([]netip.Addr)
+
+		return addrs, nil
+	}
+}
+
+func (r *Resolver) query(ctx context.Context, key cacheKey) ([]netip.Addr, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(key.name, key.qtype)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+
+	resp, err := r.transport.exchange(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("dns server returned %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	var (
+		addrs  []netip.Addr
+		minTTL uint32
+	)
+
+	for _, rr := range resp.Answer {
+		var addr netip.Addr
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA.To16())
+		default:
+			continue
+		}
+
+		if ttl := rr.Header().Ttl; len(addrs) == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+		addrs = append(addrs, addr)
+	}
+
+	ttl := r.config.Cache.NegativeTTL
+	if len(addrs) > 0 {
+		ttl = min(max(time.Duration(minTTL)*time.Second, r.config.Cache.MinTTL), r.config.Cache.MaxTTL)
+	}
+
+	r.store(key, cacheEntry{addrs: addrs, expires: time.Now().Add(ttl)})
+
+	return addrs, nil
+}
+
+func (r *Resolver) cached(key cacheKey) ([]netip.Addr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+
+	return entry.addrs, true
+}
+
+func (r *Resolver) store(key cacheKey, entry cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= r.config.Cache.Size {
+		now := time.Now()
+
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+
+		// still full, evict arbitrary entries
+		for k := range r.cache {
+			if len(r.cache) < r.config.Cache.Size {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+
+	if r.config.Cache.Size > 0 {
+		r.cache[key] = entry
+	}
+}
@@ -0,0 +1,230 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+type fakeTransport struct {
+	queries atomic.Int32
+}
+
+func (f *fakeTransport) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	f.queries.Add(1)
+
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+
+	question := msg.Question[0]
+
+	switch {
+	case question.Name != "example.com.":
+		resp.Rcode = dns.RcodeNameError
+	case question.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+
+	return resp, nil
+}
+
+func TestResolverCache(t *testing.T) {
+	transport := new(fakeTransport)
+
+	var cfg config.ResolverConfig
+	cfg.Timeout = time.Second
+	cfg.Cache.Size = 16
+	cfg.Cache.MinTTL = time.Minute
+	cfg.Cache.MaxTTL = time.Hour
+	cfg.Cache.NegativeTTL = time.Minute
+
+	r := NewResolver(cfg, nil)
+	r.transport = transport
+
+	for range 3 {
+		addrs, err := r.LookupNetIP(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("LookupNetIP() error: %v", err)
+		}
+		if len(addrs) != 1 || addrs[0].String() != "192.0.2.1" {
+			t.Errorf("got %v, want: [192.0.2.1]", addrs)
+		}
+	}
+
+	// A and AAAA are queried once, the 1s ttl is raised to the minimum
+	if got := transport.queries.Load(); got != 2 {
+		t.Errorf("got %d queries, want: 2", got)
+	}
+
+	for range 3 {
+		if _, err := r.LookupNetIP(context.Background(), "missing.example.com"); err == nil {
+			t.Error("expected error for missing host")
+		}
+	}
+
+	// negative answers are cached too
+	if got := transport.queries.Load(); got != 4 {
+		t.Errorf("got %d queries, want: 4", got)
+	}
+}
+
+type servfailTransport struct{}
+
+func (servfailTransport) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, dns.RcodeServerFailure)
+
+	return resp, nil
+}
+
+func TestResolverFallback(t *testing.T) {
+	transport := new(fakeTransport)
+
+	var cfg config.ResolverConfig
+	cfg.Timeout = time.Second
+
+	r := NewResolver(cfg, nil)
+	r.transport = fallbackTransport{servfailTransport{}, transport}
+
+	addrs, err := r.LookupNetIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "192.0.2.1" {
+		t.Errorf("got %v, want: [192.0.2.1]", addrs)
+	}
+
+	r.transport = fallbackTransport{servfailTransport{}}
+
+	if _, err = r.LookupNetIP(context.Background(), "example.com"); err == nil {
+		t.Error("expected error when every server fails")
+	}
+}
+
+func TestResolverTruncatedUDP(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+
+		// only tcp gets the answer
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			resp.Truncated = true
+		} else if msg.Question[0].Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+		}
+
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	})
+
+	var cfg config.ResolverConfig
+	cfg.Servers = []string{"udp://" + pc.LocalAddr().String()}
+	cfg.Timeout = 5 * time.Second
+
+	r := NewResolver(cfg, new(net.Dialer).DialContext)
+	if err = r.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	addrs, err := r.LookupNetIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "192.0.2.1" {
+		t.Errorf("got %v, want: [192.0.2.1]", addrs)
+	}
+}
+
+// blockingTransport answers once released, it records whether the query was cancelled by then
+type blockingTransport struct {
+	fakeTransport
+
+	started   chan struct{}
+	release   chan struct{}
+	cancelled atomic.Bool
+}
+
+func (b *blockingTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	b.started <- struct{}{}
+	<-b.release
+
+	if ctx.Err() != nil {
+		b.cancelled.Store(true)
+		return nil, ctx.Err()
+	}
+
+	return b.fakeTransport.exchange(ctx, msg)
+}
+
+func TestResolverDetachedQuery(t *testing.T) {
+	transport := &blockingTransport{started: make(chan struct{}, 1), release: make(chan struct{})}
+
+	var cfg config.ResolverConfig
+	cfg.Timeout = 5 * time.Second
+	cfg.Cache.Size = 16
+	cfg.Cache.MaxTTL = time.Hour
+
+	r := NewResolver(cfg, nil)
+	r.transport = transport
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.lookup(ctx, "example.com", dns.TypeA)
+		done <- err
+	}()
+
+	<-transport.started
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Fatal("expected error for the cancelled caller")
+	}
+
+	close(transport.release)
+
+	// the query went on without the caller and its answer is cached for the next one
+	addrs, err := r.lookup(context.Background(), "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatalf("lookup() error: %v", err)
+	}
+	if len(addrs) != 1 {
+		t.Errorf("got %v, want one address", addrs)
+	}
+	if transport.cancelled.Load() {
+		t.Error("query was cancelled with the caller")
+	}
+	if got := transport.queries.Load(); got != 1 {
+		t.Errorf("got %d queries, want: 1", got)
+	}
+}
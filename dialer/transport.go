@@ -0,0 +1,277 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxIdleConns = 4
+
+// fallbackTransport asks the servers in order until one of them answers,
+// every server gets its share of the remaining time
+type fallbackTransport []transport
+
+func (f fallbackTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var errs []error
+
+	deadline, ok := ctx.Deadline()
+
+	for i, t := range f {
+		serverCtx, cancel := ctx, func() {}
+		if ok {
+			serverCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(f)-i))
+		}
+
+		resp, err := t.exchange(serverCtx, msg.Copy())
+		cancel()
+
+		switch {
+		case err != nil:
+		case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+			return resp, nil
+		default:
+			err = fmt.Errorf("dns server returned %s", dns.RcodeToString[resp.Rcode])
+		}
+
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// udpTransport sends plain queries over udp, truncated responses are
+// repeated over tcp
+type udpTransport struct {
+	address string
+	dial    DialFunc
+	tcp     *tcpTransport
+}
+
+func newUDPTransport(address string, dial DialFunc) *udpTransport {
+	return &udpTransport{
+		address: address,
+		dial:    dial,
+		tcp:     newTCPTransport(address, nil, dial),
+	}
+}
+
+func (t *udpTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns query: %w", err)
+	}
+
+	conn, err := t.dial(ctx, "udp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("dial dns server: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(packed); err != nil {
+		return nil, fmt.Errorf("write dns query: %w", err)
+	}
+
+	b := make([]byte, dns.MaxMsgSize)
+
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("read dns response: %w", err)
+		}
+
+		// a datagram with another id is late or spoofed, keep waiting for ours
+		resp := new(dns.Msg)
+		if resp.Unpack(b[:n]) != nil || resp.Id != msg.Id {
+			continue
+		}
+
+		if resp.Truncated {
+			return t.tcp.exchange(ctx, msg)
+		}
+
+		return resp, nil
+	}
+}
+
+// tcpTransport sends queries over tcp, or over DNS-over-TLS (RFC 7858) with
+// a tls config, keeping connections open between queries
+type tcpTransport struct {
+	address   string
+	dial      DialFunc
+	tlsConfig *tls.Config
+
+	idle chan *dns.Conn
+}
+
+func newTCPTransport(address string, tlsConfig *tls.Config, dial DialFunc) *tcpTransport {
+	return &tcpTransport{
+		address:   address,
+		dial:      dial,
+		tlsConfig: tlsConfig,
+		idle:      make(chan *dns.Conn, maxIdleConns),
+	}
+}
+
+func (t *tcpTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// a pooled connection may have been closed by the server, retry once on a fresh one
+	select {
+	case conn := <-t.idle:
+		resp, err := t.exchangeWithConn(ctx, conn, msg)
+		if err == nil {
+			return resp, nil
+		}
+	default:
+	}
+
+	conn, err := t.dial(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("dial dns server: %w", err)
+	}
+
+	if t.tlsConfig != nil {
+		tlsConn := tls.Client(conn, t.tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with dns server: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	return t.exchangeWithConn(ctx, &dns.Conn{Conn: conn}, msg)
+}
+
+func (t *tcpTransport) exchangeWithConn(ctx context.Context, conn *dns.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.WriteMsg(msg); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write dns query: %w", err)
+	}
+
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read dns response: %w", err)
+	}
+
+	if resp.Id != msg.Id {
+		conn.Close()
+		return nil, dns.ErrId
+	}
+
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+
+	return resp, nil
+}
+
+// dohTransport sends queries over DNS-over-HTTPS (RFC 8484), the http client
+// keeps connections alive
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHTransport(serverURL *url.URL, serverName string, dial DialFunc) *dohTransport {
+	return &dohTransport{
+		url: serverURL.String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				// the server is an ip address, nothing is resolved, and proxy settings do not apply
+				Proxy:               nil,
+				DialContext:         dial,
+				TLSClientConfig:     &tls.Config{ServerName: serverName},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (t *dohTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// the id should be zero to make responses cache friendly
+	id := msg.Id
+	msg.Id = 0
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns query: %w", err)
+	}
+
+	// a kept-alive connection may have been closed by the server, the http client does not
+	// repeat a post on its own, so retry once on a fresh one
+	resp, err := t.post(ctx, packed)
+	if err != nil && ctx.Err() == nil {
+		resp, err = t.post(ctx, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = id
+
+	return resp, nil
+}
+
+func (t *dohTransport) post(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send dns query: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns server returned http status %d", httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("read dns response: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpack dns response: %w", err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,225 @@
+package dialer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testCertificate returns a certificate for 127.0.0.1 and a pool that trusts it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// answer replies to a query for an A record with 192.0.2.1
+func answer(msg *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+
+	return resp
+}
+
+func testQuery() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	return msg
+}
+
+// trackingListener counts the accepted connections and can close them, like a server dropping idle clients
+type trackingListener struct {
+	net.Listener
+
+	accepted atomic.Int32
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+
+	return conn, err
+}
+
+func (l *trackingListener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestTCPTransportTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracking := &trackingListener{Listener: ln}
+
+	server := &dns.Server{
+		Listener: tls.NewListener(tracking, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Net:      "tcp-tls",
+		Handler:  dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) { _ = w.WriteMsg(answer(msg)) }),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	transport := newTCPTransport(ln.Addr().String(), &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}, new(net.Dialer).DialContext)
+
+	exchange := func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		resp, err := transport.exchange(ctx, testQuery())
+		if err != nil {
+			t.Fatalf("exchange() error: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("got %d answers, want: 1", len(resp.Answer))
+		}
+	}
+
+	exchange()
+	exchange()
+
+	// the second query reuses the idle connection
+	if got := tracking.accepted.Load(); got != 1 {
+		t.Errorf("got %d connections, want: 1", got)
+	}
+
+	// the server drops the idle connection, the query is repeated on a new one
+	tracking.closeConns()
+	exchange()
+
+	if got := tracking.accepted.Load(); got != 2 {
+		t.Errorf("got %d connections, want: 2", got)
+	}
+}
+
+func TestDoHTransport(t *testing.T) {
+	var connections atomic.Int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err = msg.Unpack(body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		packed, _ := answer(msg).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL + "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := newDoHTransport(serverURL, "127.0.0.1", new(net.Dialer).DialContext)
+	transport.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	exchange := func() {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		msg := testQuery()
+		id := msg.Id
+
+		resp, err := transport.exchange(ctx, msg)
+		if err != nil {
+			t.Fatalf("exchange() error: %v", err)
+		}
+		if resp.Id != id || len(resp.Answer) != 1 {
+			t.Errorf("got id %d with %d answers, want: id %d with 1 answer", resp.Id, len(resp.Answer), id)
+		}
+	}
+
+	exchange()
+	exchange()
+
+	if got := connections.Load(); got != 1 {
+		t.Errorf("got %d connections, want: 1", got)
+	}
+
+	server.CloseClientConnections()
+	exchange()
+
+	if got := connections.Load(); got != 2 {
+		t.Errorf("got %d connections, want: 2", got)
+	}
+}
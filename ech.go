@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// extensionEncryptedClientHello marks a ClientHello that may carry an encrypted inner hello, its sni is then
+// only the public name of the client-facing server. chrome and firefox also send it as grease with random
+// content on ordinary connections, which look the same, so the extension alone does not prove ech
+const extensionEncryptedClientHello uint16 = 0xfe0d
+
+// echAnyName is the pattern of every name, it would also catch the grease of ordinary connections
+const echAnyName = "*"
+
+const (
+	// echPass routes the connection by its outer sni like any other
+	echPass = "pass"
+	// echReject answers with a fatal handshake_failure alert, this only blocks the connection,
+	// browsers do not retry without ech since only the server's retry configs would tell them to
+	echReject = "reject"
+)
+
+// echRejectAlert is a fatal handshake_failure alert record, not an ech rejection with retry configs,
+// that needs the private key of the client-facing server
+var echRejectAlert = []byte{21, 3, 3, 0, 2, 2, 40}
+
+type echRule struct {
+	pattern string
+	reject  bool
+	// host replaces the outer sni as destination when set
+	host string
+}
+
+// echRules decide what happens to connections with ech, matched on the outer sni
+type echRules struct {
+	config []string
+	rules  []echRule
+}
+
+func newECHRules(config []string) *echRules {
+	return &echRules{config: config}
+}
+
+// Init parses entries in the form "pattern=action", the action is pass, reject or a host to connect to.
+// A pattern is an exact name, "*.domain" matching any subdomain or "*" matching every name, which may only pass
+func (r *echRules) Init() error {
+	var errs []error
+
+	for _, entry := range r.config {
+		pattern, action, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || pattern == "" || action == "" {
+			errs = append(errs, fmt.Errorf("invalid ech rule %q, expected pattern=action", entry))
+			continue
+		}
+
+		rule := echRule{pattern: strings.ToLower(pattern)}
+
+		switch action {
+		case echPass:
+		case echReject:
+			rule.reject = true
+		default:
+			if _, err := netip.ParseAddr(action); err != nil && strings.ContainsAny(action, ":/;") {
+				errs = append(errs, fmt.Errorf("invalid ech rule %q, expected %s, %s or a host", entry, echPass, echReject))
+				continue
+			}
+			rule.host = action
+		}
+
+		// with grease the sni is the real name, a catch-all would reject or redirect ordinary connections
+		if rule.pattern == echAnyName && (rule.reject || rule.host != "") {
+			errs = append(errs, fmt.Errorf("invalid ech rule %q, %s would match the ech grease of ordinary connections, name the public names", entry, echAnyName))
+			continue
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return errors.Join(errs...)
+}
+
+// match returns the first rule matching the outer sni
+func (r *echRules) match(serverName string) (echRule, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	for _, rule := range r.rules {
+		if suffix, ok := strings.CutPrefix(rule.pattern, "*"); ok {
+			if strings.HasSuffix(serverName, suffix) {
+				return rule, true
+			}
+		} else if serverName == rule.pattern {
+			return rule, true
+		}
+	}
+
+	return echRule{}, false
+}
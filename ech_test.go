@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+const testPublicName = "public.example.com"
+
+// echConfigList returns an ech config list for an x25519 key, the client encrypts the inner hello to it
+func echConfigList(t *testing.T, publicName string) []byte {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(extensionEncryptedClientHello)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(1)       // config id
+			b.AddUint16(0x0020) // dhkem x25519 hkdf-sha256
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(key.PublicKey().Bytes()) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0001) // hkdf-sha256
+				b.AddUint16(0x0001) // aes-128-gcm
+			})
+			b.AddUint8(0) // maximum name length
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(publicName)) })
+			b.AddUint16(0) // extensions
+		})
+	})
+
+	return b.BytesOrPanic()
+}
+
+// echClient starts a handshake with ech to the inner name, the error of the handshake is sent on the channel
+func echClient(t *testing.T, conn net.Conn) <-chan error {
+	t.Helper()
+
+	config := echConfigList(t, testPublicName)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- tls.Client(conn, &tls.Config{
+			ServerName:                     "inner.example.com",
+			MinVersion:                     tls.VersionTLS13,
+			EncryptedClientHelloConfigList: config,
+		}).Handshake()
+	}()
+
+	return result
+}
+
+func TestSNIFromConnECH(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	echClient(t, clientConn)
+
+	hello, _, err := sniFromConn(serverConn)
+	if err != nil {
+		t.Fatalf("sniFromConn() error: %v", err)
+	}
+	if !hello.ech {
+		t.Error("ech not detected")
+	}
+	if hello.serverName != testPublicName {
+		t.Errorf("got %s, want: %s", hello.serverName, testPublicName)
+	}
+}
+
+func TestECHRules(t *testing.T) {
+	rules := newECHRules([]string{"public.example.com=reject", "*.cdn.example.com=origin.example.net", "*=pass"})
+	if err := rules.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		serverName string
+		want       echRule
+	}{
+		{"Public.Example.com.", echRule{pattern: "public.example.com", reject: true}},
+		{"a.cdn.example.com", echRule{pattern: "*.cdn.example.com", host: "origin.example.net"}},
+		{"other.example.com", echRule{pattern: "*"}},
+	} {
+		if got, ok := rules.match(tc.serverName); !ok || got != tc.want {
+			t.Errorf("%s: got %+v %v, want: %+v", tc.serverName, got, ok, tc.want)
+		}
+	}
+
+	for _, entry := range []string{"example.com", "=reject", "example.com=host:443", "*=reject", "*=origin.example.net"} {
+		if err := newECHRules([]string{entry}).Init(); err == nil {
+			t.Errorf("%q: expected error", entry)
+		}
+	}
+}
+
+// chromeClient starts a handshake with the hello of chrome, its ech extension is grease and the sni the real name
+func chromeClient(conn net.Conn, serverName string) {
+	go func() {
+		_ = utls.UClient(conn, &utls.Config{ServerName: serverName}, utls.HelloChrome_Auto).Handshake()
+	}()
+}
+
+func TestHandleConnectionGREASEECH(t *testing.T) {
+	const serverName = "www.example.com"
+
+	// grease is indistinguishable from ech
+	serverConn, clientConn := net.Pipe()
+	chromeClient(clientConn, serverName)
+
+	hello, _, err := sniFromConn(serverConn)
+	if err != nil {
+		t.Fatalf("sniFromConn() error: %v", err)
+	}
+	if !hello.ech || hello.serverName != serverName {
+		t.Errorf("got %s with ech %v, want: %s with ech", hello.serverName, hello.ech, serverName)
+	}
+
+	serverConn.Close()
+	clientConn.Close()
+
+	// rules for the public names leave the connection alone
+	rules := newECHRules([]string{"cloudflare-ech.com=reject", "*=pass"})
+	if err = rules.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	chromeClient(clientConn, serverName)
+
+	handler := &recordingHandler{host: make(chan string, 1)}
+	handleConnection(serverConn, handler, router{fallback: newFallbackRoutes(config.FallbackConfig{}), ech: rules}, time.Second, nil)
+
+	if host := <-handler.host; host != serverName {
+		t.Errorf("got host %s, want: %s", host, serverName)
+	}
+}
+
+type recordingHandler struct {
+	host chan string
+}
+
+func (*recordingHandler) Init() error { return nil }
+
+func (h *recordingHandler) Handle(_ context.Context, _ net.Conn, host string, _ uint16, _ io.Reader) {
+	h.host <- host
+}
+
+func TestHandleConnectionECH(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		host string
+	}{
+		{testPublicName + "=reject", ""},
+		{testPublicName + "=origin.example.net", "origin.example.net"},
+		{"*=pass", testPublicName},
+	} {
+		rules := newECHRules([]string{tc.rule})
+		if err := rules.Init(); err != nil {
+			t.Fatalf("Init() error: %v", err)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		handler := &recordingHandler{host: make(chan string, 1)}
+
+		result := echClient(t, clientConn)
+		handleConnection(serverConn, handler, router{fallback: newFallbackRoutes(config.FallbackConfig{}), ech: rules}, time.Second, nil)
+
+		if tc.host == "" {
+			// the alert reaches the client before the connection is closed
+			if err := <-result; err == nil || !strings.Contains(err.Error(), "handshake failure") {
+				t.Errorf("%s: got handshake error %v, want a handshake failure alert", tc.rule, err)
+			}
+			if len(handler.host) > 0 {
+				t.Errorf("%s: rejected connection was handled", tc.rule)
+			}
+		} else if host := <-handler.host; host != tc.host {
+			t.Errorf("%s: got host %s, want: %s", tc.rule, host, tc.host)
+		}
+
+		clientConn.Close()
+	}
+}
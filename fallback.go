@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+const (
+	// fallbackOriginal routes to the address the client connected to, known with a transparent or tun inbound
+	fallbackOriginal = "original"
+	// fallbackReject closes the connection
+	fallbackReject = "reject"
+)
+
+// protocol is what a connection without sni turned out to be
+type protocol string
+
+const (
+	protocolTLS  protocol = "tls"
+	protocolSSH  protocol = "ssh"
+	protocolHTTP protocol = "http"
+	protocolRaw  protocol = "raw"
+)
+
+// httpMethods are the request methods recognized at the start of a connection
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH", "PRI"}
+
+// detectProtocol guesses the protocol from the bytes peeked while looking for a ClientHello,
+// a client that waits for the server to speak first sends nothing and is raw
+func detectProtocol(peeked []byte) protocol {
+	switch {
+	case len(peeked) > 0 && peeked[0] == 0x16: // tls handshake record
+		return protocolTLS
+	case bytes.HasPrefix(peeked, []byte("SSH-")):
+		return protocolSSH
+	case isHTTPRequest(peeked):
+		return protocolHTTP
+	default:
+		return protocolRaw
+	}
+}
+
+// isHTTPRequest reports whether peeked starts with a request method, the tls record header
+// may be all that was read, so a method cut off after five bytes still counts
+func isHTTPRequest(peeked []byte) bool {
+	for _, method := range httpMethods {
+		prefix := method + " "
+		n := min(len(peeked), len(prefix))
+
+		if n >= 3 && string(peeked[:n]) == prefix[:n] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fallbackRoute is where a connection without sni goes, to the original destination when host is empty
+type fallbackRoute struct {
+	host   string
+	port   uint16
+	reject bool
+}
+
+// fallbackRoutes picks the route of a connection without sni by its protocol
+type fallbackRoutes struct {
+	config config.FallbackConfig
+	routes map[protocol]fallbackRoute
+}
+
+func newFallbackRoutes(config config.FallbackConfig) *fallbackRoutes {
+	return &fallbackRoutes{config: config}
+}
+
+func (f *fallbackRoutes) Init() error {
+	var errs []error
+
+	target, err := parseFallbackRoute(f.config.Target)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid fallback target: %w", err))
+	}
+
+	if f.config.RawTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid raw fallback timeout: %s", f.config.RawTimeout))
+	}
+
+	f.routes = make(map[protocol]fallbackRoute)
+
+	for proto, value := range map[protocol]string{
+		protocolTLS:  f.config.TLS,
+		protocolSSH:  f.config.SSH,
+		protocolHTTP: f.config.HTTP,
+		protocolRaw:  f.config.Raw,
+	} {
+		if value == "" {
+			f.routes[proto] = target
+			continue
+		}
+
+		route, err := parseFallbackRoute(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s fallback route: %w", proto, err))
+		}
+		f.routes[proto] = route
+	}
+
+	return errors.Join(errs...)
+}
+
+func parseFallbackRoute(value string) (fallbackRoute, error) {
+	switch value {
+	case fallbackOriginal, "":
+		return fallbackRoute{}, nil
+	case fallbackReject:
+		return fallbackRoute{reject: true}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		return fallbackRoute{}, fmt.Errorf("%s is not %s, %s or host:port", value, fallbackOriginal, fallbackReject)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fallbackRoute{}, fmt.Errorf("invalid port in %s", value)
+	}
+
+	if host == "" {
+		return fallbackRoute{}, fmt.Errorf("missing host in %s", value)
+	}
+
+	return fallbackRoute{host: host, port: uint16(port)}, nil
+}
+
+// rejectsAll reports whether every protocol is rejected, connections without sni then have no route at all
+func (f *fallbackRoutes) rejectsAll() bool {
+	for _, route := range f.routes {
+		if !route.reject {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rawTimeout returns how long a connection may stay silent, a client of a protocol where the server
+// speaks first sends nothing. 0 when such a connection has no route and the ClientHello timeout applies
+func (f *fallbackRoutes) rawTimeout(destination netip.AddrPort) time.Duration {
+	if _, _, ok := f.target(protocolRaw, destination); !ok {
+		return 0
+	}
+
+	return f.config.RawTimeout
+}
+
+// target returns the host and port for a connection of the protocol, false when it is rejected
+// or should go to an original destination that is not known
+func (f *fallbackRoutes) target(proto protocol, destination netip.AddrPort) (string, uint16, bool) {
+	route := f.routes[proto]
+
+	switch {
+	case route.reject:
+		return "", 0, false
+	case route.host != "":
+		return route.host, route.port, true
+	case destination.IsValid():
+		return destination.Addr().String(), destination.Port(), true
+	default:
+		return "", 0, false
+	}
+}
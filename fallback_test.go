@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		peeked string
+		want   protocol
+	}{
+		{"\x16\x03\x01\x00\x2a", protocolTLS},
+		{"SSH-2.0-OpenSSH_9.6\r\n", protocolSSH},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", protocolHTTP},
+		{"DELET", protocolHTTP},
+		{"PRI * HTTP/2.0\r\n", protocolHTTP},
+		{"GETX /", protocolRaw},
+		{"\x00\x00\x00\x01", protocolRaw},
+		{"", protocolRaw},
+	} {
+		if got := detectProtocol([]byte(tc.peeked)); got != tc.want {
+			t.Errorf("%q: got %s, want: %s", tc.peeked, got, tc.want)
+		}
+	}
+}
+
+func TestFallbackRoutes(t *testing.T) {
+	routes := newFallbackRoutes(config.FallbackConfig{
+		Target: "default.example.com:8443",
+		SSH:    "ssh.example.com:22",
+		HTTP:   fallbackOriginal,
+		Raw:    fallbackReject,
+	})
+	if err := routes.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	destination := netip.MustParseAddrPort("203.0.113.1:80")
+
+	for _, tc := range []struct {
+		proto       protocol
+		destination netip.AddrPort
+		host        string
+		port        uint16
+		ok          bool
+	}{
+		{protocolTLS, destination, "default.example.com", 8443, true},
+		{protocolSSH, destination, "ssh.example.com", 22, true},
+		{protocolHTTP, destination, "203.0.113.1", 80, true},
+		{protocolHTTP, netip.AddrPort{}, "", 0, false},
+		{protocolRaw, destination, "", 0, false},
+	} {
+		host, port, ok := routes.target(tc.proto, tc.destination)
+		if host != tc.host || port != tc.port || ok != tc.ok {
+			t.Errorf("%s to %s: got %s %d %v, want: %s %d %v", tc.proto, tc.destination, host, port, ok, tc.host, tc.port, tc.ok)
+		}
+	}
+}
+
+func TestFallbackRoutesRejectAll(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  config.FallbackConfig
+		want bool
+	}{
+		{config.FallbackConfig{Target: fallbackOriginal}, false},
+		{config.FallbackConfig{Target: fallbackReject}, true},
+		{config.FallbackConfig{Target: fallbackReject, SSH: "ssh.example.com:22"}, false},
+	} {
+		routes := newFallbackRoutes(tc.cfg)
+		if err := routes.Init(); err != nil {
+			t.Fatalf("Init() error: %v", err)
+		}
+
+		if got := routes.rejectsAll(); got != tc.want {
+			t.Errorf("%+v: got %v, want: %v", tc.cfg, got, tc.want)
+		}
+	}
+}
+
+func TestFallbackRoutesRawTimeout(t *testing.T) {
+	destination := netip.MustParseAddrPort("192.0.2.1:443")
+
+	for _, tc := range []struct {
+		cfg         config.FallbackConfig
+		destination netip.AddrPort
+		want        time.Duration
+	}{
+		{config.FallbackConfig{Target: fallbackOriginal, RawTimeout: time.Second}, destination, time.Second},
+		// the original destination is not known, a raw connection has nowhere to go
+		{config.FallbackConfig{Target: fallbackOriginal, RawTimeout: time.Second}, netip.AddrPort{}, 0},
+		{config.FallbackConfig{Target: fallbackOriginal, Raw: fallbackReject, RawTimeout: time.Second}, destination, 0},
+		{config.FallbackConfig{Target: fallbackReject, Raw: "mail.example.com:25", RawTimeout: 2 * time.Second}, netip.AddrPort{}, 2 * time.Second},
+	} {
+		routes := newFallbackRoutes(tc.cfg)
+		if err := routes.Init(); err != nil {
+			t.Fatalf("Init() error: %v", err)
+		}
+
+		if got := routes.rawTimeout(tc.destination); got != tc.want {
+			t.Errorf("%+v, %s: got %s, want: %s", tc.cfg, tc.destination, got, tc.want)
+		}
+	}
+}
+
+func TestFallbackRoutesInvalid(t *testing.T) {
+	for _, cfg := range []config.FallbackConfig{
+		{Target: "example.com"},
+		{Target: fallbackOriginal, SSH: "example.com:0"},
+		{Target: fallbackOriginal, HTTP: ":80"},
+		{Target: fallbackOriginal, Raw: "drop"},
+		{Target: fallbackOriginal, RawTimeout: -time.Second},
+	} {
+		if err := newFallbackRoutes(cfg).Init(); err == nil {
+			t.Errorf("%+v: expected error", cfg)
+		}
+	}
+}
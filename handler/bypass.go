@@ -2,57 +2,34 @@ package handler
 
 import (
 	"context"
-	"crypto/tls"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
-	"time"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 )
 
 type Bypass struct {
 	config config.BypassConfig
-
-	// custom resolver to avoid dns loops
-	resolver *net.Resolver
-}
-
-func NewBypass(config config.BypassConfig) *Bypass {
-	return &Bypass{config: config}
+	dialer *dialer.Dialer
 }
 
-func (b *Bypass) Init() error {
-	b.resolver = &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := &net.Dialer{
-				Timeout: 5 * time.Second,
-			}
-
-			tlsConfig := &tls.Config{
-				ServerName: "cloudflare-dns.com",
-			}
-
-			return tls.DialWithDialer(d, "tcp", "1.1.1.1:853", tlsConfig)
-		},
+func NewBypass(config config.BypassConfig, dialer *dialer.Dialer) *Bypass {
+	return &Bypass{
+		config: config,
+		dialer: dialer,
 	}
+}
 
+func (*Bypass) Init() error {
 	return nil
 }
 
-func (b *Bypass) Handle(ctx context.Context, conn net.Conn, sni string, reader io.Reader) {
-	// resolve upstream
-	ips, err := b.resolver.LookupHost(context.Background(), sni)
-	if err != nil || len(ips) == 0 {
-		slog.ErrorContext(ctx, "dns lookup failed", slog.String("sni", sni), slog.Any("error", err))
-		return
-	}
-	target := net.JoinHostPort(ips[0], "443")
-
-	// dial upstream
-	targetConn, err := net.DialTimeout("tcp", target, 5*time.Second)
+func (b *Bypass) Handle(ctx context.Context, conn net.Conn, host string, port uint16, reader io.Reader) {
+	// resolve and dial upstream
+	targetConn, err := b.dialer.Dial(ctx, host, port)
 	if err != nil {
 		slog.ErrorContext(ctx, "dial failed", slog.Any("error", err))
 		return
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// Direct connects to the destination without tunneling or modifying the traffic
+type Direct struct {
+	dialer *dialer.Dialer
+}
+
+func NewDirect(dialer *dialer.Dialer) *Direct {
+	return &Direct{dialer: dialer}
+}
+
+func (*Direct) Init() error {
+	return nil
+}
+
+func (d *Direct) Handle(ctx context.Context, conn net.Conn, host string, port uint16, reader io.Reader) {
+	// resolve and dial upstream
+	targetConn, err := d.dialer.Dial(ctx, host, port)
+	if err != nil {
+		slog.ErrorContext(ctx, "dial failed", slog.Any("error", err))
+		return
+	}
+	defer targetConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Go(func() { _, _ = io.Copy(conn, targetConn) })
+	wg.Go(func() { _, _ = io.Copy(targetConn, reader) })
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// newTestDialer returns a dialer that reaches the names of hosts, private destinations included
+func newTestDialer(t *testing.T, hosts ...string) *dialer.Dialer {
+	t.Helper()
+
+	h := dialer.NewHosts(hosts)
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := dialer.NewPolicy(config.PolicyConfig{AllowPrivate: true}, "127.0.0.1:0")
+	if err := policy.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dialer.New(config.DialerConfig{
+		Timeout:          time.Second,
+		AttemptDelay:     250 * time.Millisecond,
+		FamilyPreference: config.AddressFamilyIPv4,
+	}, nil, h, policy, dialer.NewOutbound(config.OutboundConfig{}))
+}
+
+func TestDirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server echoes one line and closes
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 64)
+		n, _ := conn.Read(b)
+		_, _ = conn.Write(b[:n])
+	}()
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	d := NewDirect(newTestDialer(t, "echo.test=127.0.0.1"))
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close()
+
+		// the peeked bytes come first, then the rest of the connection
+		d.Handle(context.Background(), serverConn, "echo.test", port, io.MultiReader(strings.NewReader("peeked"), serverConn))
+	}()
+
+	reply := make([]byte, len("peeked"))
+	if _, err = io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(reply) != "peeked" {
+		t.Errorf("got %q, want: %q", reply, "peeked")
+	}
+
+	clientConn.Close()
+	<-done
+}
+
+func TestDirectDeniedDestination(t *testing.T) {
+	policy := dialer.NewPolicy(config.PolicyConfig{}, "127.0.0.1:0")
+	if err := policy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDirect(dialer.New(config.DialerConfig{Timeout: time.Second}, nil, nil, policy, dialer.NewOutbound(config.OutboundConfig{})))
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	// a loopback destination is refused and the handler returns without touching the client
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Handle(context.Background(), serverConn, "127.0.0.1", 443, serverConn)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle() did not return for a denied destination")
+	}
+}
@@ -11,50 +11,116 @@ import (
 	"time"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 	"git.capy.fun/sni-proxy/upstream"
 )
 
 type Proxy struct {
 	config   config.ProxyConfig
+	resolver *dialer.Resolver
+	hosts    *dialer.Hosts
+	policy   *dialer.Policy
+	outbound *dialer.Outbound
 	upstream Upstream
 }
 
 type Upstream interface {
 	Init() error
-	Connect(sni string, timeout time.Duration) (net.Conn, error)
+	Connect(host string, port uint16, timeout time.Duration) (net.Conn, error)
 	Close() error
 }
 
-func NewProxy(config config.ProxyConfig) *Proxy {
-	return &Proxy{config: config}
+func NewProxy(config config.ProxyConfig, resolver *dialer.Resolver, hosts *dialer.Hosts, policy *dialer.Policy, outbound *dialer.Outbound) *Proxy {
+	return &Proxy{
+		config:   config,
+		resolver: resolver,
+		hosts:    hosts,
+		policy:   policy,
+		outbound: outbound,
+	}
 }
 
 func (p *Proxy) Init() error {
+	var err error
+
+	if p.upstream, err = p.newUpstream(); err != nil {
+		return err
+	}
+
+	if err = p.upstream.Init(); err != nil {
+		return fmt.Errorf("failed to initialize upstream: %w", err)
+	}
+
+	return nil
+}
+
+// Validate checks the upstream configuration without connecting or starting anything,
+// upstreams that do so in Init validate on their own, the others only parse their configuration in Init
+func (p *Proxy) Validate() error {
+	u, err := p.newUpstream()
+	if err != nil {
+		return err
+	}
+
+	if v, ok := u.(interface{ Validate() error }); ok {
+		err = v.Validate()
+	} else {
+		err = u.Init()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid upstream: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Proxy) newUpstream() (Upstream, error) {
 	switch p.config.UpstreamType {
 	case config.UpstreamTypeHttpProxy:
-		p.upstream = upstream.NewHttpProxy(p.config.HttpProxyConfig)
+		return upstream.NewHttpProxy(p.config.HttpProxyConfig, p.outbound), nil
+	case config.UpstreamTypeHysteria2:
+		return upstream.NewHysteria2(p.config.Hysteria2Config, p.outbound), nil
+	case config.UpstreamTypeNaive:
+		return upstream.NewNaive(p.config.NaiveConfig, p.outbound), nil
+	case config.UpstreamTypeShadowsocks:
+		return upstream.NewShadowsocks(p.config.ShadowsocksConfig, p.outbound), nil
 	case config.UpstreamTypeSSH:
-		p.upstream = upstream.NewSSH(p.config.SSHConfig)
+		return upstream.NewSSH(p.config.SSHConfig, p.outbound), nil
+	case config.UpstreamTypeTrojan:
+		return upstream.NewTrojan(p.config.TrojanConfig, p.outbound), nil
 	case config.UpstreamTypeVLESSReality:
-		p.upstream = upstream.NewVlessReality(p.config.VLESSRealityConfig)
+		if p.config.VLESSRealityConfig.Subscription != "" {
+			return upstream.NewVLESSSubscription(p.config.VLESSRealityConfig, p.outbound), nil
+		}
+		return upstream.NewVlessReality(p.config.VLESSRealityConfig, p.outbound), nil
+	case config.UpstreamTypeVMess:
+		return upstream.NewVMess(p.config.VMessConfig, p.outbound), nil
 	case config.UpstreamTypeWireguard:
-		p.upstream = upstream.NewWireguard(p.config.WireguardConfig)
+		return upstream.NewWireguard(p.config.WireguardConfig, p.outbound, p.resolver, p.hosts, p.policy), nil
 	case "":
-		return errors.New("upstream type not specified")
+		return nil, errors.New("upstream type not specified")
 	default:
-		return fmt.Errorf("unsupported upstream type: %s", p.config.UpstreamType)
+		return nil, fmt.Errorf("unsupported upstream type: %s", p.config.UpstreamType)
 	}
+}
 
-	if err := p.upstream.Init(); err != nil {
-		return fmt.Errorf("failed to initialize upstream: %w", err)
+func (p *Proxy) Handle(ctx context.Context, conn net.Conn, host string, port uint16, reader io.Reader) {
+	// the wireguard upstream resolves names itself and applies the overrides with all their addresses
+	target := host
+	if p.config.UpstreamType != config.UpstreamTypeWireguard {
+		target = p.hosts.Target(host)
+	}
+	if target != host {
+		slog.DebugContext(ctx, "host overridden", slog.String("host", host), slog.String("target", target))
 	}
 
-	return nil
-}
+	if err := p.policy.CheckHost(target, port); err != nil {
+		slog.ErrorContext(ctx, "destination rejected", slog.Any("error", err))
+		return
+	}
 
-func (p *Proxy) Handle(ctx context.Context, conn net.Conn, sni string, reader io.Reader) {
 	// dial upstream
-	upstreamConn, err := p.upstream.Connect(sni, p.config.UpstreamTimeout)
+	upstreamConn, err := p.upstream.Connect(target, port, p.config.UpstreamTimeout)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to connect to upstream", slog.Any("error", err))
 		return
@@ -0,0 +1,89 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// Transparent accepts the connections a firewall diverted to the proxy. REDIRECT rewrites the destination
+// of a connection and keeps the original one for SO_ORIGINAL_DST, TPROXY leaves it as the local address
+type Transparent struct {
+	mode    config.InboundType
+	address string
+
+	listener net.Listener
+}
+
+func NewTransparent(mode config.InboundType, address string) *Transparent {
+	return &Transparent{
+		mode:    mode,
+		address: address,
+	}
+}
+
+var errTransparentUnsupported = errors.New("the transparent inbounds are only supported on linux")
+
+func (t *Transparent) Init() error {
+	if !transparentSupported {
+		return errTransparentUnsupported
+	}
+
+	var lc net.ListenConfig
+
+	if t.mode == config.InboundTypeTProxy {
+		// tproxy hands over connections to addresses of other hosts, only a transparent socket may accept them
+		lc.Control = setTransparent
+	}
+
+	listener, err := lc.Listen(context.Background(), "tcp", t.address)
+	if err != nil {
+		return err
+	}
+
+	t.listener = listener
+
+	return nil
+}
+
+func (t *Transparent) Accept() (net.Conn, error) {
+	return t.listener.Accept()
+}
+
+func (t *Transparent) Close() error {
+	return t.listener.Close()
+}
+
+func (t *Transparent) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Destination returns the address the client connected to,
+// it is not valid for a connection that was made to the proxy itself and not redirected
+func (t *Transparent) Destination(conn net.Conn) (netip.AddrPort, error) {
+	if t.mode == config.InboundTypeTProxy {
+		return localAddrPort(conn)
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected connection type %T", conn)
+	}
+
+	return originalDestination(tcpConn)
+}
+
+func localAddrPort(conn net.Conn) (netip.AddrPort, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected local address %v", conn.LocalAddr())
+	}
+
+	addrPort := addr.AddrPort()
+
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), nil
+}
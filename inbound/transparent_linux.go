@@ -0,0 +1,95 @@
+package inbound
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+func setTransparent(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp4" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			return
+		}
+
+		// a dual-stack socket needs both options
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); sockErr != nil {
+			return
+		}
+		if network != "tcp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to make socket transparent: %w", sockErr)
+	}
+
+	return nil
+}
+
+// originalDestination asks conntrack for the destination before the REDIRECT rule rewrote it
+func originalDestination(conn *net.TCPConn) (netip.AddrPort, error) {
+	local, err := localAddrPort(conn)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var (
+		destination netip.AddrPort
+		sockErr     error
+	)
+
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Is4() {
+			// the option fills a sockaddr_in, which fits into the 16 bytes of an ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); sockErr == nil {
+				destination = netip.AddrPortFrom(
+					netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8])),
+					binary.BigEndian.Uint16(mreq.Multiaddr[2:4]),
+				)
+			}
+			return
+		}
+
+		// IP6T_SO_ORIGINAL_DST has the same value and fills a sockaddr_in6, the start of an ip6_mtuinfo
+		var info *unix.IPv6MTUInfo
+		if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST); sockErr == nil {
+			// the port is kept in network byte order
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			destination = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// conntrack has no nat entry for connections that were not redirected, or is not loaded at all
+	if errors.Is(sockErr, unix.ENOENT) || errors.Is(sockErr, unix.ENOPROTOOPT) {
+		return netip.AddrPort{}, nil
+	}
+	if sockErr != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to get original destination: %w", sockErr)
+	}
+
+	return destination, nil
+}
@@ -0,0 +1,173 @@
+package inbound
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// netns returns a function that runs commands and functions on a thread in a new network namespace,
+// sockets stay in the namespace they were created in, so only their creation has to run there
+func netns(t *testing.T) func(fn func() error) error {
+	t.Helper()
+
+	funcs := make(chan func())
+	ready := make(chan error)
+
+	go func() {
+		// the thread is never unlocked, it exits with the goroutine instead of going back to the pool
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ready <- err
+			return
+		}
+		ready <- nil
+
+		for fn := range funcs {
+			fn()
+		}
+	}()
+
+	if err := <-ready; err != nil {
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	t.Cleanup(func() { close(funcs) })
+
+	return func(fn func() error) error {
+		errc := make(chan error)
+		funcs <- func() { errc <- fn() }
+		return <-errc
+	}
+}
+
+func command(line string) func() error {
+	return func() error {
+		args := strings.Fields(line)
+
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", line, err, out)
+		}
+
+		return nil
+	}
+}
+
+// TestTransparent sets up the firewall rules for both modes in a namespace, a connection to 198.51.100.7:443
+// ends up at the proxy, which learns the address the client connected to
+func TestTransparent(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables is not available")
+	}
+
+	for _, tc := range []struct {
+		mode  config.InboundType
+		rules []string
+	}{
+		{
+			mode: config.InboundTypeRedirect,
+			rules: []string{
+				"ip route add 198.51.100.0/24 dev lo",
+				"iptables -t nat -A OUTPUT -p tcp -d 198.51.100.0/24 --dport 443 -j REDIRECT --to-ports %d",
+			},
+		},
+		{
+			// local connections only pass prerouting when they are routed back in through the loopback
+			mode: config.InboundTypeTProxy,
+			rules: []string{
+				"ip rule add fwmark 1 lookup 100",
+				"ip route add local 0.0.0.0/0 dev lo table 100",
+				"ip route add 198.51.100.0/24 dev lo",
+				"iptables -t mangle -A OUTPUT -p tcp -d 198.51.100.0/24 --dport 443 -j MARK --set-mark 1",
+				"iptables -t mangle -A PREROUTING -p tcp -d 198.51.100.0/24 --dport 443 -j TPROXY --on-ip 127.0.0.1 --on-port %d --tproxy-mark 1",
+			},
+		},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			run := netns(t)
+
+			if err := run(command("ip link set lo up")); err != nil {
+				t.Skip(err)
+			}
+
+			in := NewTransparent(tc.mode, "127.0.0.1:0")
+			if err := run(in.Init); err != nil {
+				t.Fatalf("Init() error: %v", err)
+			}
+			defer in.Close()
+
+			port := in.Addr().(*net.TCPAddr).Port
+
+			for _, rule := range tc.rules {
+				if strings.Contains(rule, "%d") {
+					rule = fmt.Sprintf(rule, port)
+				}
+				if err := run(command(rule)); err != nil {
+					t.Skipf("the firewall rules can not be set up: %v", err)
+				}
+			}
+
+			var client net.Conn
+			err := run(func() (err error) {
+				client, err = net.DialTimeout("tcp", "198.51.100.7:443", 5*time.Second)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Dial() error: %v", err)
+			}
+			defer client.Close()
+
+			conn, err := in.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error: %v", err)
+			}
+			defer conn.Close()
+
+			destination, err := in.Destination(conn)
+			if err != nil {
+				t.Fatalf("Destination() error: %v", err)
+			}
+			if expected := netip.MustParseAddrPort("198.51.100.7:443"); destination != expected {
+				t.Errorf("got destination %s, want: %s", destination, expected)
+			}
+		})
+	}
+}
+
+func TestTransparentNotRedirected(t *testing.T) {
+	in := NewTransparent(config.InboundTypeRedirect, "127.0.0.1:0")
+	if err := in.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	defer in.Close()
+
+	client, err := net.Dial("tcp", in.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := in.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a client that connects to the proxy itself has no other destination
+	destination, err := in.Destination(conn)
+	if err != nil {
+		t.Fatalf("Destination() error: %v", err)
+	}
+	if destination.IsValid() {
+		t.Errorf("got destination %s, want none", destination)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package inbound
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+const transparentSupported = false
+
+func setTransparent(_, _ string, _ syscall.RawConn) error {
+	return errTransparentUnsupported
+}
+
+func originalDestination(_ *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
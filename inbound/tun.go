@@ -0,0 +1,266 @@
+package inbound
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+const (
+	tunNIC tcpip.NICID = 1
+	// tunOffset leaves room for the virtio header the linux device puts in front of a packet
+	tunOffset = 16
+	// tunMaxInFlight limits the handshakes the stack completes at the same time
+	tunMaxInFlight = 1024
+)
+
+// TUN terminates the tcp connections routed into a tun device with the gVisor network stack,
+// they are accepted like the connections of a listener, with the original destination as local address
+type TUN struct {
+	config config.TUNConfig
+	// allPorts accepts connections to any port, for the fallback routes of connections without sni
+	allPorts bool
+
+	dev   tun.Device
+	stack *stack.Stack
+	ep    *channel.Endpoint
+
+	conns  chan net.Conn
+	done   chan struct{}
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func NewTUN(config config.TUNConfig, allPorts bool) *TUN {
+	return &TUN{config: config, allPorts: allPorts}
+}
+
+// Init creates the tun device, or takes the one of the fd, and starts the stack
+func (t *TUN) Init() error {
+	if t.config.MTU < 1280 {
+		return fmt.Errorf("tun mtu %d is below the ipv6 minimum of 1280", t.config.MTU)
+	}
+
+	dev, err := openTUN(t.config)
+	if err != nil {
+		return fmt.Errorf("open tun: %w", err)
+	}
+
+	if err = t.start(dev); err != nil {
+		_ = dev.Close()
+		return err
+	}
+
+	return nil
+}
+
+// start runs the stack on a device, it accepts tcp connections to every address
+func (t *TUN) start(dev tun.Device) error {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+
+	sackEnabled := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabled); err != nil {
+		s.Close()
+		return fmt.Errorf("enable tcp sack: %s", err)
+	}
+
+	ep := channel.New(1024, uint32(t.config.MTU), "")
+
+	if err := s.CreateNIC(tunNIC, ep); err != nil {
+		s.Close()
+		return fmt.Errorf("create nic: %s", err)
+	}
+
+	// the stack has no address of its own, it takes the packets to every destination and answers as that destination
+	if err := s.SetPromiscuousMode(tunNIC, true); err != nil {
+		s.Close()
+		return fmt.Errorf("enable promiscuous mode: %s", err)
+	}
+	if err := s.SetSpoofing(tunNIC, true); err != nil {
+		s.Close()
+		return fmt.Errorf("enable spoofing: %s", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	forwarder := tcp.NewForwarder(s, 0, tunMaxInFlight, t.forward)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.dev = dev
+	t.stack = s
+	t.ep = ep
+	t.conns = make(chan net.Conn)
+	t.done = make(chan struct{})
+	t.cancel = cancel
+
+	go t.readPackets()
+	go t.writePackets(ctx)
+
+	return nil
+}
+
+// forward completes the handshake of a connection to port 443, connections to other ports are reset
+// unless the fallback routes may take them
+func (t *TUN) forward(r *tcp.ForwarderRequest) {
+	if !t.allPorts && r.ID().LocalPort != 443 {
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	conn := gonet.NewTCPConn(&wq, ep)
+
+	select {
+	case t.conns <- conn:
+	case <-t.done:
+		_ = conn.Close()
+	}
+}
+
+// readPackets hands the packets of the device to the stack
+func (t *TUN) readPackets() {
+	batchSize := t.dev.BatchSize()
+
+	bufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+
+	// offloading may hand out segments of up to 64k
+	for i := range bufs {
+		bufs[i] = make([]byte, tunOffset+0xffff)
+	}
+
+	for {
+		n, err := t.dev.Read(bufs, sizes, tunOffset)
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				slog.Error("failed to read from tun", slog.Any("error", err))
+				_ = t.Close()
+			}
+			return
+		}
+
+		for i := range n {
+			packet := bufs[i][tunOffset : tunOffset+sizes[i]]
+			if len(packet) == 0 {
+				continue
+			}
+
+			var protocol tcpip.NetworkProtocolNumber
+
+			switch header.IPVersion(packet) {
+			case header.IPv4Version:
+				protocol = header.IPv4ProtocolNumber
+			case header.IPv6Version:
+				protocol = header.IPv6ProtocolNumber
+			default:
+				continue
+			}
+
+			pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+			t.ep.InjectInbound(protocol, pkb)
+			pkb.DecRef()
+		}
+	}
+}
+
+// writePackets hands the packets of the stack to the device
+func (t *TUN) writePackets(ctx context.Context) {
+	for {
+		pkb := t.ep.ReadContext(ctx)
+		if pkb == nil {
+			return
+		}
+
+		view := pkb.ToView()
+		pkb.DecRef()
+
+		buf := make([]byte, tunOffset+view.Size())
+		_, _ = view.Read(buf[tunOffset:])
+		view.Release()
+
+		if _, err := t.dev.Write([][]byte{buf}, tunOffset); err != nil {
+			slog.Debug("failed to write to tun", slog.Any("error", err))
+		}
+	}
+}
+
+// Accept returns the next connection routed into the device
+func (t *TUN) Accept() (net.Conn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *TUN) Close() error {
+	var err error
+
+	t.once.Do(func() {
+		close(t.done)
+		t.cancel()
+
+		err = t.dev.Close()
+		t.stack.Close()
+		t.ep.Close()
+	})
+
+	return err
+}
+
+// Destination returns the address the client connected to, the stack answers as that address
+func (*TUN) Destination(conn net.Conn) (netip.AddrPort, error) {
+	return localAddrPort(conn)
+}
+
+// Addr returns the name of the device
+func (t *TUN) Addr() net.Addr {
+	name, err := t.dev.Name()
+	if err != nil {
+		name = "tun"
+	}
+
+	return tunAddr(name)
+}
+
+type tunAddr string
+
+func (tunAddr) Network() string { return "tun" }
+
+func (a tunAddr) String() string { return string(a) }
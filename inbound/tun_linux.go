@@ -0,0 +1,18 @@
+package inbound
+
+import (
+	"os"
+
+	"golang.zx2c4.com/wireguard/tun"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// openTUN takes the device of an inherited fd, like one passed by a container runtime, or creates it by name
+func openTUN(config config.TUNConfig) (tun.Device, error) {
+	if config.FD > 0 {
+		return tun.CreateTUNFromFile(os.NewFile(uintptr(config.FD), "tun"), config.MTU)
+	}
+
+	return tun.CreateTUN(config.Name, config.MTU)
+}
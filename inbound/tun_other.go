@@ -0,0 +1,15 @@
+//go:build !linux
+
+package inbound
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/tun"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func openTUN(_ config.TUNConfig) (tun.Device, error) {
+	return nil, errors.New("the tun inbound is only supported on linux")
+}
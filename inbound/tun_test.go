@@ -0,0 +1,104 @@
+package inbound
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+func TestTUN(t *testing.T) {
+	// the device of a client stack stands in for the kernel device, the client routes everything into it
+	dev, client, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")}, nil, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewTUN(config.TUNConfig{MTU: 1500}, false)
+	if err = in.start(dev); err != nil {
+		t.Fatalf("start() error: %v", err)
+	}
+	defer in.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, destination := range []string{"203.0.113.7:443", "[2001:db8::7]:443"} {
+		addr := netip.MustParseAddrPort(destination)
+
+		go func() {
+			conn, err := client.DialContextTCPAddrPort(ctx, addr)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write([]byte("ping"))
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+
+		conn, err := in.Accept()
+		if err != nil {
+			t.Fatalf("Accept() error: %v", err)
+		}
+
+		if got := conn.LocalAddr().String(); got != destination {
+			t.Errorf("got local address %s, want: %s", got, destination)
+		}
+
+		b := make([]byte, 4)
+		if _, err = io.ReadFull(conn, b); err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if string(b) != "ping" {
+			t.Errorf("got %q, want: %q", b, "ping")
+		}
+		conn.Close()
+	}
+
+	// only port 443 is terminated
+	if _, err = client.DialContextTCPAddrPort(ctx, netip.MustParseAddrPort("203.0.113.7:80")); err == nil {
+		t.Error("expected connection to port 80 to be reset")
+	}
+}
+
+func TestTUNAllPorts(t *testing.T) {
+	dev, client, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewTUN(config.TUNConfig{MTU: 1500}, true)
+	if err = in.start(dev); err != nil {
+		t.Fatalf("start() error: %v", err)
+	}
+	defer in.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		conn, err := client.DialContextTCPAddrPort(ctx, netip.MustParseAddrPort("203.0.113.7:22"))
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := in.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.LocalAddr().String(); got != "203.0.113.7:22" {
+		t.Errorf("got local address %s, want: 203.0.113.7:22", got)
+	}
+}
@@ -3,23 +3,46 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 	"git.capy.fun/sni-proxy/handler"
+	"git.capy.fun/sni-proxy/inbound"
 )
 
 type ConnectionHandler interface {
 	Init() error
-	Handle(ctx context.Context, conn net.Conn, sni string, reader io.Reader)
+	Handle(ctx context.Context, conn net.Conn, host string, port uint16, reader io.Reader)
+}
+
+// validator is implemented by connection handlers that start upstreams in Init,
+// Validate only checks their configuration
+type validator interface {
+	Validate() error
+}
+
+// destinationListener is an inbound that knows the address a connection was meant for
+type destinationListener interface {
+	net.Listener
+	Destination(conn net.Conn) (netip.AddrPort, error)
+}
+
+// router holds the routes of connections the sni alone does not decide
+type router struct {
+	fallback *fallbackRoutes
+	ech      *echRules
 }
 
 func main() {
@@ -30,68 +53,222 @@ func main() {
 }
 
 func run() error {
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, list every problem and exit")
+	flag.Parse()
+
 	var cfg config.Config
-	if err := envconfig.Process("", &cfg); err != nil {
-		return err
+	processErr := envconfig.Process("", &cfg)
+
+	// a variable that fails to parse is one more problem, the rest of the configuration is still checked
+	if *checkConfig {
+		setupLogger(cfg.LogLevel)
+		return reportProblems(errors.Join(processErr, check(cfg)))
 	}
 
-	setupLogger(cfg.LogLevel)
+	if processErr != nil {
+		return processErr
+	}
 
-	var connectionHandler ConnectionHandler
+	setupLogger(cfg.LogLevel)
 
-	switch cfg.Mode {
-	case config.ModeProxy:
-		connectionHandler = handler.NewProxy(cfg.ProxyConfig)
-	case config.ModeBypass:
-		connectionHandler = handler.NewBypass(cfg.BypassConfig)
-	case "":
-		return errors.New("mode not specified")
-	default:
-		return fmt.Errorf("unsupported mode: %s", cfg.Mode)
+	connectionHandler, routes, err := setup(cfg)
+	if err != nil {
+		return err
 	}
 
-	if err := connectionHandler.Init(); err != nil {
+	if err = connectionHandler.Init(); err != nil {
 		return fmt.Errorf("failed to initialize connection handler: %w", err)
 	}
 
-	ln, err := net.Listen("tcp", cfg.ListenAddress)
+	ln, err := listen(cfg, routes)
 	if err != nil {
 		return err
 	}
-	slog.Info("server is listening", slog.String("address", cfg.ListenAddress))
+	slog.Info("server is listening", slog.String("address", ln.Addr().String()))
+
+	destinations, _ := ln.(destinationListener)
 
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			slog.Error("failed to accept connection", slog.Any("error", err))
 			continue
 		}
 
-		go handleConnection(conn, connectionHandler, cfg.ClientHelloTimeout)
+		go handleConnection(conn, connectionHandler, routes, cfg.ClientHelloTimeout, destinations)
+	}
+}
+
+// listen returns the listener of the inbound, a tcp listener or the connections routed into a tun device,
+// which takes every port when connections without sni can be routed
+func listen(cfg config.Config, routes router) (net.Listener, error) {
+	switch cfg.InboundConfig.Type {
+	case config.InboundTypeListen:
+		return net.Listen("tcp", cfg.ListenAddress)
+	case config.InboundTypeTUN:
+		tunInbound := inbound.NewTUN(cfg.InboundConfig.TUNConfig, !routes.fallback.rejectsAll())
+		if err := tunInbound.Init(); err != nil {
+			return nil, fmt.Errorf("failed to initialize tun inbound: %w", err)
+		}
+		return tunInbound, nil
+	case config.InboundTypeRedirect, config.InboundTypeTProxy:
+		transparent := inbound.NewTransparent(cfg.InboundConfig.Type, cfg.ListenAddress)
+		if err := transparent.Init(); err != nil {
+			return nil, fmt.Errorf("failed to initialize %s inbound: %w", cfg.InboundConfig.Type, err)
+		}
+		return transparent, nil
+	default:
+		return nil, fmt.Errorf("unsupported inbound: %s", cfg.InboundConfig.Type)
+	}
+}
+
+// check validates the configuration like setup, the connection handler is validated instead
+// of initialized, so no upstream connects or starts in the background
+func check(cfg config.Config) error {
+	connectionHandler, _, err := setup(cfg)
+	if connectionHandler == nil {
+		return err
+	}
+
+	var handlerErr error
+	if v, ok := connectionHandler.(validator); ok {
+		handlerErr = v.Validate()
+	} else {
+		handlerErr = connectionHandler.Init()
+	}
+	if handlerErr != nil {
+		handlerErr = fmt.Errorf("invalid connection handler: %w", handlerErr)
+	}
+
+	return errors.Join(err, handlerErr)
+}
+
+// setup creates every component and initializes all but the connection handler,
+// collecting all configuration problems
+func setup(cfg config.Config) (ConnectionHandler, router, error) {
+	var errs []error
+
+	switch cfg.InboundConfig.Type {
+	case config.InboundTypeListen, config.InboundTypeTUN, config.InboundTypeRedirect, config.InboundTypeTProxy:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported inbound: %s", cfg.InboundConfig.Type))
+	}
+
+	routes := router{
+		fallback: newFallbackRoutes(cfg.FallbackConfig),
+		ech:      newECHRules(cfg.ECHRules),
+	}
+	if err := routes.fallback.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize fallback routes: %w", err))
+	}
+	if err := routes.ech.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse ech rules: %w", err))
+	}
+
+	outbound := dialer.NewOutbound(cfg.OutboundConfig)
+	if err := outbound.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize outbound options: %w", err))
+	}
+
+	resolver := dialer.NewResolver(cfg.ResolverConfig, outbound.DialContext)
+	if err := resolver.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize resolver: %w", err))
+	}
+
+	hosts := dialer.NewHosts(cfg.Hosts)
+	if err := hosts.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse hosts: %w", err))
+	}
+
+	policy := dialer.NewPolicy(cfg.PolicyConfig, cfg.ListenAddress)
+	if err := policy.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize destination policy: %w", err))
+	}
+
+	destDialer := dialer.New(cfg.DialerConfig, resolver, hosts, policy, outbound)
+	if err := destDialer.Init(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize dialer: %w", err))
+	}
+
+	var connectionHandler ConnectionHandler
+
+	switch cfg.Mode {
+	case config.ModeProxy:
+		connectionHandler = handler.NewProxy(cfg.ProxyConfig, resolver, hosts, policy, outbound)
+	case config.ModeBypass:
+		connectionHandler = handler.NewBypass(cfg.BypassConfig, destDialer)
+	case config.ModeDirect:
+		connectionHandler = handler.NewDirect(destDialer)
+	case "":
+		return nil, routes, errors.Join(append(errs, errors.New("mode not specified"))...)
+	default:
+		return nil, routes, errors.Join(append(errs, fmt.Errorf("unsupported mode: %s", cfg.Mode))...)
 	}
+
+	return connectionHandler, routes, errors.Join(errs...)
 }
 
-func handleConnection(conn net.Conn, connectionHandler ConnectionHandler, clientHelloTimeout time.Duration) {
+func handleConnection(conn net.Conn, connectionHandler ConnectionHandler, routes router, clientHelloTimeout time.Duration, destinations destinationListener) {
 	defer conn.Close()
 
 	ctx := context.WithValue(context.Background(), connIDKey, uuid.NewString())
 
-	// set a read deadline for ClientHello peek
-	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
-		return
+	// the port and, for the fallback routes, the address come from the original destination when the inbound knows it
+	var destination netip.AddrPort
+
+	if destinations != nil {
+		var err error
+		if destination, err = destinations.Destination(conn); err != nil {
+			slog.ErrorContext(ctx, "failed to get original destination", slog.Any("error", err))
+			return
+		}
 	}
 
-	sni, reader, err := sniFromConn(conn)
+	// set a read deadline for ClientHello peek, a silent client gets a shorter one when it can be routed as raw
+	helloConn, err := newHelloReader(conn, clientHelloTimeout, routes.fallback.rawTimeout(destination))
 	if err != nil {
-		slog.ErrorContext(ctx, "failed to get sni from connection", slog.Any("error", err))
 		return
 	}
-	slog.DebugContext(ctx, "new client connection", slog.String("sni", sni))
+
+	hello, reader, err := sniFromConn(helloConn)
+
+	host, port := hello.serverName, uint16(443)
+	if destination.IsValid() {
+		port = destination.Port()
+	}
+
+	switch {
+	// without sni the connection is routed by its protocol, the peeked bytes are replayed to the target
+	case err != nil:
+		proto := detectProtocol(hello.peeked)
+
+		var ok bool
+		if host, port, ok = routes.fallback.target(proto, destination); !ok {
+			slog.ErrorContext(ctx, "no route for connection", slog.Any("error", err), slog.String("protocol", string(proto)))
+			return
+		}
+		slog.DebugContext(ctx, "routing connection without sni", slog.String("protocol", string(proto)))
+	// with ech the sni is only the public name, the real destination is encrypted
+	case hello.ech:
+		rule, ok := routes.ech.match(hello.serverName)
+		switch {
+		case ok && rule.reject:
+			slog.InfoContext(ctx, "rejecting ech connection", slog.String("sni", hello.serverName))
+			_, _ = conn.Write(echRejectAlert)
+			return
+		case ok && rule.host != "":
+			host = rule.host
+		}
+	}
+	slog.DebugContext(ctx, "new client connection", slog.String("sni", hello.serverName), slog.Bool("ech", hello.ech), slog.String("destination", net.JoinHostPort(host, strconv.Itoa(int(port)))))
 
 	// reset deadline to no deadline
-	_ = conn.SetReadDeadline(time.Time{})
+	_ = helloConn.clearDeadline()
 
-	connectionHandler.Handle(ctx, conn, sni, reader)
+	connectionHandler.Handle(ctx, conn, host, port, reader)
 
-	slog.DebugContext(ctx, "client connection closed", slog.String("sni", sni))
+	slog.DebugContext(ctx, "client connection closed", slog.String("sni", hello.serverName))
 }
@@ -4,30 +4,99 @@ import (
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"slices"
 	"time"
 )
 
-func sniFromConn(conn io.Reader) (string, io.Reader, error) {
+var errNoSNI = errors.New("sni not found in client hello")
+
+// clientHello is what the first bytes of a connection tell about it
+type clientHello struct {
+	serverName string
+	// ech is set when the hello is the outer one of encrypted client hello, serverName is its public name
+	ech bool
+	// peeked holds everything read while looking for the ClientHello, also when it is not tls
+	peeked []byte
+}
+
+// sniFromConn peeks at the ClientHello, the returned reader replays the peeked bytes,
+// also when there is no sni so the connection can still be forwarded. without a ClientHello
+// the error wraps errNoSNI and the reason it was not read
+func sniFromConn(conn io.Reader) (clientHello, io.Reader, error) {
 	var (
-		sni         string
+		hello       clientHello
+		parsed      bool
 		peekedBytes = new(bytes.Buffer)
 		reader      = io.TeeReader(conn, peekedBytes)
 	)
 
-	_ = tls.Server(wrappedConn{conn: reader}, &tls.Config{
+	err := tls.Server(wrappedConn{conn: reader}, &tls.Config{
 		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
-			sni = info.ServerName
+			parsed = true
+			hello.serverName = info.ServerName
+			hello.ech = slices.Contains(info.Extensions, extensionEncryptedClientHello)
 			return nil, nil
 		},
 	}).Handshake()
 
-	if sni == "" {
-		return "", nil, errors.New("sni not found in client hello")
+	hello.peeked = peekedBytes.Bytes()
+	reader = io.MultiReader(peekedBytes, conn)
+
+	switch {
+	case !parsed:
+		return hello, reader, fmt.Errorf("%w: %w", errNoSNI, err)
+	case hello.serverName == "":
+		return hello, reader, errNoSNI
+	}
+
+	return hello, reader, nil
+}
+
+// helloReader reads with a short timeout until the first bytes arrive,
+// then with the deadline for the whole ClientHello
+type helloReader struct {
+	conn     net.Conn
+	deadline time.Time
+	started  bool
+}
+
+// newHelloReader sets the deadline for the first bytes of conn, firstByteTimeout only applies
+// when it is set and shorter than the timeout of the whole ClientHello
+func newHelloReader(conn net.Conn, timeout, firstByteTimeout time.Duration) (*helloReader, error) {
+	now := time.Now()
+
+	firstDeadline := timeout
+	if firstByteTimeout > 0 {
+		firstDeadline = min(timeout, firstByteTimeout)
+	}
+
+	if err := conn.SetReadDeadline(now.Add(firstDeadline)); err != nil {
+		return nil, err
+	}
+
+	return &helloReader{conn: conn, deadline: now.Add(timeout)}, nil
+}
+
+func (r *helloReader) Read(b []byte) (int, error) {
+	n, err := r.conn.Read(b)
+	if n > 0 && !r.started {
+		r.started = true
+		if deadlineErr := r.conn.SetReadDeadline(r.deadline); deadlineErr != nil && err == nil {
+			err = deadlineErr
+		}
 	}
 
-	return sni, io.MultiReader(peekedBytes, conn), nil
+	return n, err
+}
+
+// clearDeadline removes the deadline once the ClientHello is read, the handler reads through r from then on
+func (r *helloReader) clearDeadline() error {
+	r.started = true
+
+	return r.conn.SetReadDeadline(time.Time{})
 }
 
 type wrappedConn struct {
@@ -2,8 +2,12 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestSNIFromConn(t *testing.T) {
@@ -23,11 +27,108 @@ func TestSNIFromConn(t *testing.T) {
 		_ = tlsClient.Handshake()
 	}()
 
-	sni, _, err := sniFromConn(serverConn)
+	hello, _, err := sniFromConn(serverConn)
 	if err != nil {
 		t.Fatalf("sniFromConn() error: %v", err)
 	}
-	if sni != wantSNI {
-		t.Errorf("got %s, want: %s", sni, wantSNI)
+	if hello.serverName != wantSNI {
+		t.Errorf("got %s, want: %s", hello.serverName, wantSNI)
+	}
+}
+
+func TestSNIFromConnWithoutSNI(t *testing.T) {
+	const banner = "SSH-2.0-OpenSSH_9.6\r\n"
+
+	serverConn, clientConn := net.Pipe()
+
+	defer serverConn.Close()
+
+	go func() {
+		_, _ = clientConn.Write([]byte(banner))
+		clientConn.Close()
+	}()
+
+	hello, reader, err := sniFromConn(serverConn)
+	if !errors.Is(err, errNoSNI) {
+		t.Fatalf("got error %v, want: %v", err, errNoSNI)
+	}
+	// the reason is kept, here the banner is no tls record
+	var recordErr tls.RecordHeaderError
+	if !errors.As(err, &recordErr) {
+		t.Errorf("got error %v, want a tls.RecordHeaderError", err)
+	}
+	if protocol := detectProtocol(hello.peeked); protocol != protocolSSH {
+		t.Errorf("got protocol %s, want: %s", protocol, protocolSSH)
+	}
+
+	// the peeked bytes are replayed for forwarding
+	replayed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(replayed) != banner {
+		t.Errorf("got %q, want: %q", replayed, banner)
+	}
+}
+
+func TestHelloReader(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// a client that sent its first bytes has the whole timeout for the rest
+	go func() {
+		_, _ = clientConn.Write([]byte{0x16})
+		time.Sleep(500 * time.Millisecond)
+		_, _ = clientConn.Write([]byte{0x03})
+	}()
+
+	reader, err := newHelloReader(serverConn, 5*time.Second, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(reader, b); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+}
+
+func TestHelloReaderSilent(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		firstByteTimeout time.Duration
+		want             time.Duration
+	}{
+		{"raw route", 200 * time.Millisecond, 200 * time.Millisecond},
+		// without a raw route there is nothing to gain from giving up early
+		{"no raw route", 0, time.Second},
+		{"longer than the hello timeout", 5 * time.Second, time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			reader, err := newHelloReader(serverConn, time.Second, tc.firstByteTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+
+			hello, _, err := sniFromConn(reader)
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got error %v, want: %v", err, os.ErrDeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed < tc.want || elapsed > tc.want+500*time.Millisecond {
+				t.Errorf("silent client took %s, want about %s", elapsed, tc.want)
+			}
+			if protocol := detectProtocol(hello.peeked); protocol != protocolRaw {
+				t.Errorf("got protocol %s, want: %s", protocol, protocolRaw)
+			}
+		})
 	}
 }
@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type Upstream interface {
+	Init() error
+	Connect(host string, port uint16, timeout time.Duration) (net.Conn, error)
+	Close() error
+}
+
+// Group spreads connections over its members in round-robin order,
+// falling back to the next member when one fails to connect
+type Group struct {
+	members []Upstream
+	next    atomic.Uint32
+}
+
+func NewGroup(members ...Upstream) *Group {
+	return &Group{members: members}
+}
+
+func (g *Group) Init() error {
+	if len(g.members) == 0 {
+		return errors.New("upstream group is empty")
+	}
+
+	var errs []error
+
+	for i, member := range g.members {
+		if err := member.Init(); err != nil {
+			errs = append(errs, fmt.Errorf("member %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (g *Group) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	start := int(g.next.Add(1) - 1)
+
+	var errs []error
+
+	for i := range g.members {
+		member := g.members[(start+i)%len(g.members)]
+
+		conn, err := member.Connect(host, port, timeout)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (g *Group) Close() error {
+	var errs []error
+
+	for _, member := range g.members {
+		if err := member.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
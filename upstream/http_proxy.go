@@ -7,40 +7,55 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 )
 
 type HttpProxy struct {
-	config config.HttpProxyConfig
+	config   config.HttpProxyConfig
+	outbound *dialer.Outbound
+
+	authorization string
 }
 
-func NewHttpProxy(config config.HttpProxyConfig) *HttpProxy {
-	return &HttpProxy{config: config}
+func NewHttpProxy(config config.HttpProxyConfig, outbound *dialer.Outbound) *HttpProxy {
+	return &HttpProxy{
+		config:   config,
+		outbound: outbound,
+	}
 }
 
-func (*HttpProxy) Init() error {
+func (h *HttpProxy) Init() error {
+	if err := validateAddress(h.config.Address); err != nil {
+		return err
+	}
+
+	credentials := h.config.Username + ":" + h.config.Password
+	h.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+
 	return nil
 }
 
-func (h *HttpProxy) Connect(sni string, timeout time.Duration) (net.Conn, error) {
+func (h *HttpProxy) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
 	// dial upstream HTTP proxy
-	upstreamConn, err := net.Dial("tcp", h.config.Address)
+	d := h.outbound.Dialer()
+	d.Timeout = timeout
+
+	upstreamConn, err := d.Dial("tcp", h.config.Address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to upstream proxy: %v", err)
 	}
 
 	// send CONNECT request to upstream proxy with Basic Auth
-	credentials := h.config.Username + ":" + h.config.Password
-	authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
-
 	connectReq := &http.Request{
 		URL:    new(url.URL),
 		Method: http.MethodConnect,
-		Host:   net.JoinHostPort(sni, "443"),
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
 		Header: http.Header{
-			"Proxy-Authorization": []string{authHeader},
+			"Proxy-Authorization": []string{h.authorization},
 		},
 	}
 
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/hysteria"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/finalmask"
+	"github.com/xtls/xray-core/transport/internet/finalmask/salamander"
+	xhysteria "github.com/xtls/xray-core/transport/internet/hysteria"
+	"github.com/xtls/xray-core/transport/internet/tls"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+type Hysteria2 struct {
+	config   config.Hysteria2Config
+	outbound *dialer.Outbound
+
+	dest           xnet.Destination
+	streamSettings *internet.MemoryStreamConfig
+}
+
+func NewHysteria2(config config.Hysteria2Config, outbound *dialer.Outbound) *Hysteria2 {
+	return &Hysteria2{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (h *Hysteria2) Init() error {
+	var errs []error
+
+	if err := validateAddress(h.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	if h.config.Password == "" {
+		errs = append(errs, errors.New("password is empty"))
+	}
+
+	var pins [][]byte
+
+	if h.config.PinSHA256 != "" {
+		// the hysteria client takes the hash as hex, optionally separated by colons
+		pin, err := hex.DecodeString(strings.ReplaceAll(h.config.PinSHA256, ":", ""))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode certificate pin: %w", err))
+		} else if len(pin) != 32 {
+			errs = append(errs, fmt.Errorf("certificate pin is %d bytes long, expected 32", len(pin)))
+		} else {
+			pins = append(pins, pin)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// the transport dials the server over udp, the network here only selects it
+	dest, err := xnet.ParseDestination("tcp:" + h.config.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+
+	serverName := h.config.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(h.config.Address)
+	}
+
+	h.dest = dest
+	h.streamSettings = &internet.MemoryStreamConfig{
+		ProtocolName: "hysteria",
+		ProtocolSettings: &xhysteria.Config{
+			Version: 2,
+			Auth:    h.config.Password,
+		},
+		SecurityType: "tls",
+		SecuritySettings: &tls.Config{
+			ServerName:           serverName,
+			NextProtocol:         []string{"h3"},
+			PinnedPeerCertSha256: pins,
+		},
+	}
+
+	if h.config.ObfsPassword != "" {
+		h.streamSettings.UdpmaskManager = finalmask.NewUdpmaskManager([]finalmask.Udpmask{
+			&salamander.Config{Password: h.config.ObfsPassword},
+		})
+	}
+
+	useOutbound(h.outbound)
+
+	return nil
+}
+
+// Connect opens a stream on the quic connection to the server, xray-core keeps
+// one connection per server and dials a new one once it has dropped
+func (h *Hysteria2) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := internet.Dial(ctx, h.dest, h.streamSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial hysteria2 server: %w", err)
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+
+	if err = hysteria.WriteTCPRequest(conn, net.JoinHostPort(host, strconv.Itoa(int(port)))); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write hysteria2 request: %w", err)
+	}
+
+	ok, message, err := hysteria.ReadTCPResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read hysteria2 response: %w", err)
+	}
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("hysteria2 server refused the connection: %s", message)
+	}
+
+	// reset deadline
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to reset deadline: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (h *Hysteria2) Close() error {
+	return nil
+}
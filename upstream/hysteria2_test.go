@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/hysteria"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/finalmask"
+	"github.com/xtls/xray-core/transport/internet/finalmask/salamander"
+	xhysteria "github.com/xtls/xray-core/transport/internet/hysteria"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/internet/tls"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+type hysteria2Stream struct {
+	target string
+	remote string
+}
+
+// hysteria2Server listens with the xray-core hysteria transport and echoes every stream
+func hysteria2Server(t *testing.T, password, obfsPassword string, streams chan<- hysteria2Stream) (string, string) {
+	t.Helper()
+
+	cert, _ := testCertificate(t, "hysteria.test")
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := &internet.MemoryStreamConfig{
+		ProtocolName:     "hysteria",
+		ProtocolSettings: &xhysteria.Config{Version: 2, Auth: password},
+		SecurityType:     "tls",
+		SecuritySettings: &tls.Config{
+			NextProtocol: []string{"h3"},
+			Certificate: []*tls.Certificate{{
+				Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+				Key:         pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+				// without a reload ticker that rewrites the certificate while handshakes read it
+				OneTimeLoading: true,
+			}},
+		},
+	}
+
+	if obfsPassword != "" {
+		settings.UdpmaskManager = finalmask.NewUdpmaskManager([]finalmask.Udpmask{
+			&salamander.Config{Password: obfsPassword},
+		})
+	}
+
+	ln, err := xhysteria.Listen(context.Background(), xnet.LocalHostIP, 0, settings, func(conn stat.Connection) {
+		defer conn.Close()
+
+		target, err := hysteria.ReadTCPRequest(conn)
+		if err != nil {
+			return
+		}
+		streams <- hysteria2Stream{target: target, remote: conn.RemoteAddr().String()}
+
+		if err = hysteria.WriteTCPResponse(conn, true, ""); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	pin := sha256.Sum256(cert.Certificate[0])
+
+	return ln.Addr().String(), hex.EncodeToString(pin[:])
+}
+
+func TestHysteria2(t *testing.T) {
+	for _, obfsPassword := range []string{"", "obfs"} {
+		streams := make(chan hysteria2Stream, 2)
+		address, pin := hysteria2Server(t, "secret", obfsPassword, streams)
+
+		h := NewHysteria2(config.Hysteria2Config{
+			Address:      address,
+			Password:     "secret",
+			ServerName:   "hysteria.test",
+			PinSHA256:    pin,
+			ObfsPassword: obfsPassword,
+		}, dialer.NewOutbound(config.OutboundConfig{}))
+
+		if err := h.Init(); err != nil {
+			t.Fatalf("Init() error: %v", err)
+		}
+
+		var remotes []string
+
+		// the target is sent as a host:port string, an ipv6 address needs its brackets
+		for _, target := range []struct {
+			host string
+			port uint16
+			want string
+		}{
+			{"example.com", 443, "example.com:443"},
+			{"2001:db8::1", 853, "[2001:db8::1]:853"},
+		} {
+			conn, err := h.Connect(target.host, target.port, 5*time.Second)
+			if err != nil {
+				t.Fatalf("obfs %q: Connect() error: %v", obfsPassword, err)
+			}
+
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+
+			reply := make([]byte, 4)
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if string(reply) != "ping" {
+				t.Errorf("got %q, want: %q", reply, "ping")
+			}
+
+			stream := <-streams
+			if stream.target != target.want {
+				t.Errorf("got target %s, want: %s", stream.target, target.want)
+			}
+			remotes = append(remotes, stream.remote)
+
+			conn.Close()
+		}
+
+		// both streams share one quic connection
+		if remotes[0] != remotes[1] {
+			t.Errorf("streams came from %s and %s, want a single connection", remotes[0], remotes[1])
+		}
+	}
+}
+
+func TestHysteria2WrongPassword(t *testing.T) {
+	address, pin := hysteria2Server(t, "secret", "", make(chan hysteria2Stream))
+
+	h := NewHysteria2(config.Hysteria2Config{
+		Address:    address,
+		Password:   "wrong",
+		ServerName: "hysteria.test",
+		PinSHA256:  pin,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err := h.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	if _, err := h.Connect("example.com", 443, 5*time.Second); err == nil || !strings.Contains(err.Error(), "auth failed") {
+		t.Errorf("got error %v, want: auth failed", err)
+	}
+}
@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/log"
+)
+
+// discardHandler drops the messages of xray-core, its default handler prints every debug line
+type discardHandler struct{}
+
+func (discardHandler) Handle(log.Message) {}
+
+// tunnelDNSCertificate is served by the dns servers inside the test tunnel. the resolver of the wireguard
+// upstream verifies them against the system roots, so the certificate is trusted through SSL_CERT_FILE
+var tunnelDNSCertificate tls.Certificate
+
+const tunnelDNSServerName = "dns.test"
+
+func TestMain(m *testing.M) {
+	log.RegisterHandler(discardHandler{})
+
+	dir, err := trustTunnelDNSCertificate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// trustTunnelDNSCertificate must run before the first verification, the system roots are loaded only once
+func trustTunnelDNSCertificate() (string, error) {
+	certificate, _, err := generateCertificate(tunnelDNSServerName)
+	if err != nil {
+		return "", err
+	}
+	tunnelDNSCertificate = certificate
+
+	dir, err := os.MkdirTemp("", "upstream-test")
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dir, "roots.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	if err = os.WriteFile(file, data, 0o600); err != nil {
+		return dir, err
+	}
+
+	return dir, os.Setenv("SSL_CERT_FILE", file)
+}
+
+// generateCertificate returns a self-signed certificate for name
+func generateCertificate(name string) (tls.Certificate, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, nil
+}
@@ -0,0 +1,468 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"golang.org/x/net/http2"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// naivePaddingFrames is the number of reads and writes at the start of a stream that carry padding
+const naivePaddingFrames = 8
+
+// naivePaddingChars are not in the hpack huffman table, so the padding header keeps its length on the wire
+const naivePaddingChars = "!#$()+<>?@[]^`{}"
+
+type Naive struct {
+	config   config.NaiveConfig
+	outbound *dialer.Outbound
+
+	authorization string
+	tlsConfig     *tls.Config
+	fingerprint   *utls.ClientHelloID
+	transport     *http2.Transport
+
+	mu   sync.Mutex
+	conn *http2.ClientConn
+	// dial is the connection being dialed, concurrent connects wait for it instead of dialing their own
+	dial   *naiveDial
+	closed bool
+}
+
+type naiveDial struct {
+	done chan struct{}
+
+	conn *http2.ClientConn
+	err  error
+}
+
+func NewNaive(config config.NaiveConfig, outbound *dialer.Outbound) *Naive {
+	return &Naive{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (n *Naive) Init() error {
+	var errs []error
+
+	if err := validateAddress(n.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	if n.config.Fingerprint != "" {
+		if err := validateFingerprint(n.config.Fingerprint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if n.config.Username != "" || n.config.Password != "" {
+		credentials := n.config.Username + ":" + n.config.Password
+		n.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	serverName := n.config.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(n.config.Address)
+	}
+
+	n.tlsConfig = &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{http2.NextProtoTLS},
+	}
+
+	// a fingerprint offers h2 along with the other protocols of its browser
+	if n.config.Fingerprint != "" {
+		n.fingerprint = xtls.GetFingerprint(n.config.Fingerprint)
+		n.tlsConfig.NextProtos = nil
+	}
+
+	n.transport = &http2.Transport{}
+
+	return nil
+}
+
+func (n *Naive) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	cc, err := n.clientConn(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream is bound to the request context, so it lives as long as the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(timeout, cancel)
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	body, writer := io.Pipe()
+
+	req := (&http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Host: target},
+		Host:          target,
+		Header:        http.Header{},
+		Body:          body,
+		ContentLength: -1,
+	}).WithContext(ctx)
+
+	if n.authorization != "" {
+		req.Header.Set("Proxy-Authorization", n.authorization)
+	}
+
+	if n.config.Padding {
+		req.Header.Set("Padding", naivePaddingHeader())
+	}
+
+	resp, err := cc.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to send connect request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("upstream proxy rejected connect request, code: %d", resp.StatusCode)
+	}
+
+	return &NaiveConn{
+		reader: resp.Body,
+		writer: writer,
+		cancel: cancel,
+		// the server answers with a padding header when it supports the extension
+		padding: n.config.Padding && resp.Header.Get("Padding") != "",
+	}, nil
+}
+
+// clientConn returns the pooled http2 connection, a new one is dialed
+// once the server sent a GOAWAY or the connection is at its stream limit
+func (n *Naive) clientConn(timeout time.Duration) (*http2.ClientConn, error) {
+	n.mu.Lock()
+
+	if n.closed {
+		n.mu.Unlock()
+		return nil, errors.New("naive upstream is closed")
+	}
+
+	if n.conn != nil {
+		if cc := n.conn; cc.CanTakeNewRequest() {
+			n.mu.Unlock()
+			return cc, nil
+		}
+
+		// running streams finish before the old connection is closed
+		go func(cc *http2.ClientConn) { _ = cc.Shutdown(context.Background()) }(n.conn)
+		n.conn = nil
+	}
+
+	if d := n.dial; d != nil {
+		n.mu.Unlock()
+
+		<-d.done
+		return d.conn, d.err
+	}
+
+	d := &naiveDial{done: make(chan struct{})}
+	n.dial = d
+	n.mu.Unlock()
+
+	// the dial can take as long as the timeout, Close and other connects are not held up by it
+	d.conn, d.err = n.dialConn(timeout)
+
+	n.mu.Lock()
+	n.dial = nil
+	if d.err == nil {
+		if n.closed {
+			_ = d.conn.Close()
+			d.conn, d.err = nil, errors.New("naive upstream is closed")
+		} else {
+			n.conn = d.conn
+		}
+	}
+	n.mu.Unlock()
+
+	close(d.done)
+
+	return d.conn, d.err
+}
+
+// dialConn connects to the proxy and starts an http2 connection
+func (n *Naive) dialConn(timeout time.Duration) (*http2.ClientConn, error) {
+	d := n.outbound.Dialer()
+	d.Timeout = timeout
+
+	tcpConn, err := d.Dial("tcp", n.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream proxy: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := tlsHandshake(ctx, tcpConn, n.tlsConfig, n.fingerprint)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	// a server without h2 would answer the http2 preface with garbage
+	if protocol := negotiatedProtocol(conn); protocol != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy negotiated %q instead of h2", protocol)
+	}
+
+	cc, err := n.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start http2 connection: %w", err)
+	}
+
+	return cc, nil
+}
+
+func (n *Naive) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+
+	if n.conn == nil {
+		return nil
+	}
+
+	return n.conn.Close()
+}
+
+// naivePaddingHeader returns a random value of 16 to 32 characters
+func naivePaddingHeader() string {
+	value := make([]byte, 16+rand.IntN(17))
+	for i := range value {
+		value[i] = naivePaddingChars[rand.IntN(len(naivePaddingChars))]
+	}
+
+	return string(value)
+}
+
+// NaiveConn is a CONNECT stream, with the naiveproxy padding the first frames in
+// each direction are prefixed with the payload and padding size and followed by the padding
+type NaiveConn struct {
+	reader io.ReadCloser
+	writer io.WriteCloser
+	cancel context.CancelFunc
+
+	padding       bool
+	readPaddings  int
+	writePaddings int
+	pending       []byte
+
+	// reads run in the background so a deadline can interrupt them, the next read picks up the result
+	inflight chan naiveRead
+	readBuf  []byte
+	buffered []byte
+	readErr  error
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	// deadlineSet is closed when the read deadline changes, so a waiting read picks up the new one
+	deadlineSet chan struct{}
+}
+
+type naiveRead struct {
+	n   int
+	err error
+}
+
+func (c *NaiveConn) Read(b []byte) (int, error) {
+	if len(c.buffered) > 0 {
+		n := copy(b, c.buffered)
+		c.buffered = c.buffered[n:]
+		return n, nil
+	}
+
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	if c.inflight == nil {
+		if cap(c.readBuf) < len(b) {
+			c.readBuf = make([]byte, len(b))
+		}
+		buf := c.readBuf[:len(b)]
+
+		inflight := make(chan naiveRead, 1)
+		go func() {
+			n, err := c.readStream(buf)
+			inflight <- naiveRead{n: n, err: err}
+		}()
+		c.inflight = inflight
+	}
+
+	for {
+		deadline, deadlineSet := c.deadline()
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		select {
+		case result := <-c.inflight:
+			stopTimer(timer)
+			c.inflight = nil
+
+			n := copy(b, c.readBuf[:result.n])
+			c.buffered = c.readBuf[n:result.n]
+			if len(c.buffered) > 0 {
+				// the error follows the rest of the data
+				c.readErr = result.err
+				return n, nil
+			}
+			return n, result.err
+		case <-deadlineSet:
+			stopTimer(timer)
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// readStream reads from the stream and strips the padding of the first frames
+func (c *NaiveConn) readStream(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if !c.padding || c.readPaddings >= naivePaddingFrames {
+		return c.reader.Read(b)
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:2]))
+
+	frame := make([]byte, size+int(header[2]))
+	if _, err := io.ReadFull(c.reader, frame); err != nil {
+		return 0, err
+	}
+
+	c.readPaddings++
+
+	n := copy(b, frame[:size])
+	c.pending = frame[n:size]
+
+	return n, nil
+}
+
+func (c *NaiveConn) Write(b []byte) (int, error) {
+	written := 0
+
+	for c.padding && c.writePaddings < naivePaddingFrames && len(b) > 0 {
+		size := min(len(b), math.MaxUint16)
+		padding := rand.IntN(256)
+
+		frame := make([]byte, 3+size+padding)
+		binary.BigEndian.PutUint16(frame, uint16(size))
+		frame[2] = byte(padding)
+		copy(frame[3:], b[:size])
+
+		if _, err := c.writer.Write(frame); err != nil {
+			return written, err
+		}
+
+		c.writePaddings++
+		written += size
+		b = b[size:]
+	}
+
+	if len(b) == 0 {
+		return written, nil
+	}
+
+	n, err := c.writer.Write(b)
+
+	return written + n, err
+}
+
+func (c *NaiveConn) Close() error {
+	if c.cancel != nil {
+		defer c.cancel()
+	}
+
+	return errors.Join(c.writer.Close(), c.reader.Close())
+}
+
+// deadline returns the read deadline and a channel that is closed when it changes
+func (c *NaiveConn) deadline() (time.Time, <-chan struct{}) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	if c.deadlineSet == nil {
+		c.deadlineSet = make(chan struct{})
+	}
+
+	return c.readDeadline, c.deadlineSet
+}
+
+// SetDeadline sets the read deadline, see SetWriteDeadline
+func (c *NaiveConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *NaiveConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+	if c.deadlineSet != nil {
+		close(c.deadlineSet)
+	}
+	c.deadlineSet = make(chan struct{})
+
+	return nil
+}
+
+// SetWriteDeadline is not supported, a write blocks only on http2 flow control
+// and the pipe to the request body cannot abandon a write halfway
+func (*NaiveConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// the stream has no addresses of its own
+
+func (*NaiveConn) LocalAddr() net.Addr { return nil }
+
+func (*NaiveConn) RemoteAddr() net.Addr { return nil }
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
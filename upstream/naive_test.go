@@ -0,0 +1,361 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// flushWriter sends every write as its own data frame
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, http.NewResponseController(f.w).Flush()
+}
+
+func (flushWriter) Close() error { return nil }
+
+// naiveConns counts the connections the naive test server accepted and reports the closed ones
+type naiveConns struct {
+	opened atomic.Int32
+	closed chan struct{}
+}
+
+// naiveServer is a forward proxy that answers CONNECT streams with an echo, like caddy forwardproxy
+// it pads the first frames when the client asked for it
+func naiveServer(t *testing.T, idleTimeout time.Duration, targets chan<- string) (string, *x509.CertPool, *naiveConns) {
+	t.Helper()
+
+	cert, pool := testCertificate(t, "naive.test")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := &naiveConns{closed: make(chan struct{}, 1)}
+
+	srv := &http.Server{
+		IdleTimeout: idleTimeout,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2"},
+		},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.opened.Add(1)
+			case http.StateClosed:
+				select {
+				case conns.closed <- struct{}{}:
+				default:
+				}
+			}
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			targets <- r.Host
+
+			padding := r.Header.Get("Padding") != ""
+			if padding {
+				w.Header().Set("Padding", naivePaddingHeader())
+			}
+
+			w.WriteHeader(http.StatusOK)
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				return
+			}
+
+			conn := &NaiveConn{reader: r.Body, writer: flushWriter{w}, padding: padding}
+			_, _ = io.Copy(conn, conn)
+		}),
+	}
+
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return ln.Addr().String(), pool, conns
+}
+
+// naiveEcho opens a stream and echoes more writes through it than frames are padded
+func naiveEcho(t *testing.T, naive *Naive, targets <-chan string) {
+	t.Helper()
+
+	conn, err := naive.Connect("example.com", 443, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	if target := <-targets; target != "example.com:443" {
+		t.Errorf("got target %s, want: example.com:443", target)
+	}
+
+	for range naivePaddingFrames + 2 {
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+
+		reply := make([]byte, 4)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if string(reply) != "ping" {
+			t.Errorf("got %q, want: %q", reply, "ping")
+		}
+	}
+}
+
+func newTestNaive(t *testing.T, address string, pool *x509.CertPool, fingerprint string, padding bool) *Naive {
+	t.Helper()
+
+	naive := NewNaive(config.NaiveConfig{
+		Address:     address,
+		Username:    "user",
+		Password:    "secret",
+		ServerName:  "naive.test",
+		Fingerprint: fingerprint,
+		Padding:     padding,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err := naive.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	naive.tlsConfig.RootCAs = pool
+
+	t.Cleanup(func() { _ = naive.Close() })
+
+	return naive
+}
+
+func TestNaive(t *testing.T) {
+	for _, padding := range []bool{false, true} {
+		targets := make(chan string, 1)
+		address, pool, conns := naiveServer(t, 0, targets)
+
+		naive := newTestNaive(t, address, pool, "", padding)
+
+		naiveEcho(t, naive, targets)
+		naiveEcho(t, naive, targets)
+
+		if n := conns.opened.Load(); n != 1 {
+			t.Errorf("padding %v: got %d connections, want: 1", padding, n)
+		}
+	}
+}
+
+func TestNaiveGoAway(t *testing.T) {
+	targets := make(chan string, 1)
+	// the server sends a GOAWAY once the connection is idle
+	address, pool, conns := naiveServer(t, 100*time.Millisecond, targets)
+
+	naive := newTestNaive(t, address, pool, "chrome", true)
+
+	naiveEcho(t, naive, targets)
+
+	// the client closes the idle connection once it got the GOAWAY
+	select {
+	case <-conns.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not close the idle connection")
+	}
+
+	naiveEcho(t, naive, targets)
+
+	if n := conns.opened.Load(); n != 2 {
+		t.Errorf("got %d connections, want: 2", n)
+	}
+}
+
+func TestNaiveWrongPassword(t *testing.T) {
+	targets := make(chan string, 1)
+	address, pool, _ := naiveServer(t, 0, targets)
+
+	naive := NewNaive(config.NaiveConfig{
+		Address:    address,
+		Username:   "user",
+		Password:   "wrong",
+		ServerName: "naive.test",
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err := naive.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	naive.tlsConfig.RootCAs = pool
+	t.Cleanup(func() { _ = naive.Close() })
+
+	if _, err := naive.Connect("example.com", 443, time.Second); err == nil || !strings.Contains(err.Error(), "code: 407") {
+		t.Errorf("got error %v, want: code: 407", err)
+	}
+	if len(targets) != 0 {
+		t.Error("the server accepted a request with the wrong password")
+	}
+}
+
+func TestNaiveConcurrentDial(t *testing.T) {
+	// the server accepts connections but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	naive := newTestNaive(t, ln.Addr().String(), nil, "", false)
+
+	errs := make(chan error, 2)
+	connect := func() {
+		_, err := naive.Connect("example.com", 443, time.Second)
+		errs <- err
+	}
+
+	go connect()
+	conn := <-accepted
+	defer conn.Close()
+
+	// the second connect waits for the dial in progress
+	go connect()
+
+	closed := make(chan struct{})
+	go func() {
+		_ = naive.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Close() waited for the dial")
+	}
+
+	for range 2 {
+		if err := <-errs; err == nil {
+			t.Error("expected Connect() to fail")
+		}
+	}
+
+	if len(accepted) != 0 {
+		t.Error("the second connect dialed a connection of its own")
+	}
+}
+
+func TestNaiveWithoutH2(t *testing.T) {
+	cert, pool := testCertificate(t, "naive.test")
+
+	// a server without alpn completes the handshake without a protocol
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	for _, fingerprint := range []string{"", "chrome"} {
+		naive := newTestNaive(t, ln.Addr().String(), pool, fingerprint, false)
+
+		if _, err := naive.Connect("example.com", 443, time.Second); err == nil || !strings.Contains(err.Error(), "instead of h2") {
+			t.Errorf("fingerprint %q: got error %v, want: instead of h2", fingerprint, err)
+		}
+	}
+}
+
+func TestNaiveReadDeadline(t *testing.T) {
+	targets := make(chan string, 1)
+	address, pool, _ := naiveServer(t, 0, targets)
+
+	naive := newTestNaive(t, address, pool, "", true)
+
+	conn, err := naive.Connect("example.com", 443, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+	<-targets
+
+	// the echo server has nothing to send yet
+	if err = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want: %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// the stream survives the deadline, the interrupted read picks up the echo
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("got %q, want: %q", reply, "ping")
+	}
+
+	// a deadline moved into the past wakes up a waiting read
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 4))
+		errs <- err
+	}()
+
+	if err = conn.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want: %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read did not return after the deadline")
+	}
+}
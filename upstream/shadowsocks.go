@@ -0,0 +1,212 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// shadowsocksHeaderDelay is how long the request header waits for the first payload
+const shadowsocksHeaderDelay = 100 * time.Millisecond
+
+type Shadowsocks struct {
+	config   config.ShadowsocksConfig
+	outbound *dialer.Outbound
+
+	method shadowsocks.Method
+}
+
+func NewShadowsocks(config config.ShadowsocksConfig, outbound *dialer.Outbound) *Shadowsocks {
+	return &Shadowsocks{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (s *Shadowsocks) Init() error {
+	if s.config.URL != "" {
+		cfg, err := ParseShadowsocksLink(s.config.URL)
+		if err != nil {
+			return err
+		}
+		s.config = cfg
+	}
+
+	var errs []error
+
+	if err := validateAddress(s.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	if s.config.Password == "" {
+		errs = append(errs, errors.New("password is empty"))
+	}
+
+	aead := slices.Contains(shadowaead.List, s.config.Method)
+	if !aead && !slices.Contains(shadowaead_2022.List, s.config.Method) {
+		errs = append(errs, fmt.Errorf("unsupported shadowsocks method: %q", s.config.Method))
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	var err error
+
+	if aead {
+		s.method, err = shadowaead.New(s.config.Method, nil, s.config.Password)
+	} else {
+		// the password is a base64 key, or a list of them separated by ":"
+		// where the leading keys are sent as identity headers
+		s.method, err = shadowaead_2022.NewWithPassword(s.config.Method, s.config.Password, time.Now)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid shadowsocks password: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Shadowsocks) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	d := s.outbound.Dialer()
+	d.Timeout = timeout
+
+	conn, err := d.Dial("tcp", s.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial shadowsocks server: %w", err)
+	}
+
+	// the request header is sent together with the first write, or alone after a delay
+	// so a server that speaks first, like smtp or ssh, learns the destination
+	ssConn := &shadowsocksConn{
+		Conn: s.method.DialEarlyConn(conn, M.ParseSocksaddrHostPort(host, port)),
+		sent: make(chan struct{}),
+	}
+	ssConn.flushTimer = time.AfterFunc(shadowsocksHeaderDelay, ssConn.flushHeader)
+
+	return ssConn, nil
+}
+
+func (s *Shadowsocks) Close() error {
+	return nil
+}
+
+// shadowsocksConn serializes the writes, the header is written once by the first write or the timer
+type shadowsocksConn struct {
+	net.Conn
+
+	mu         sync.Mutex
+	flushTimer *time.Timer
+	// sent is closed once the header is out, the response is decoded with the state of the request
+	sent     chan struct{}
+	sentOnce sync.Once
+}
+
+func (c *shadowsocksConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.markSent()
+
+	return c.Conn.Write(b)
+}
+
+func (c *shadowsocksConn) Read(b []byte) (int, error) {
+	<-c.sent
+
+	return c.Conn.Read(b)
+}
+
+// flushHeader writes the header without payload unless a write already carried it
+func (c *shadowsocksConn) flushHeader() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.markSent()
+
+	if early, ok := c.Conn.(N.EarlyConn); ok && early.NeedHandshake() {
+		_, _ = c.Conn.Write(nil)
+	}
+}
+
+func (c *shadowsocksConn) markSent() {
+	c.sentOnce.Do(func() { close(c.sent) })
+}
+
+func (c *shadowsocksConn) Close() error {
+	c.flushTimer.Stop()
+	// a waiting read fails on the closed connection
+	c.markSent()
+
+	return c.Conn.Close()
+}
+
+// ParseShadowsocksLink converts a SIP002 ss:// uri into an upstream config, e.g.
+// ss://base64url(method:password)@host:port#name
+// or ss://method:percent-encoded-password@host:port#name for the 2022 ciphers
+func ParseShadowsocksLink(link string) (config.ShadowsocksConfig, error) {
+	var cfg config.ShadowsocksConfig
+
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid shadowsocks link: %w", err)
+	}
+
+	if u.Scheme != "ss" {
+		return cfg, fmt.Errorf("unsupported link scheme: %q", u.Scheme)
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return cfg, errors.New("shadowsocks link has no user info")
+	}
+
+	if u.Port() == "" {
+		return cfg, errors.New("shadowsocks link has no port")
+	}
+
+	if u.Query().Has("plugin") {
+		return cfg, errors.New("shadowsocks plugins are not supported")
+	}
+
+	cfg.Address = u.Host
+
+	if password, ok := u.User.Password(); ok {
+		cfg.Method = u.User.Username()
+		cfg.Password = password
+
+		return cfg, nil
+	}
+
+	var userInfo []byte
+
+	for _, encoding := range []*base64.Encoding{
+		base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding,
+	} {
+		if userInfo, err = encoding.DecodeString(u.User.Username()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to decode shadowsocks user info: %w", err)
+	}
+
+	var found bool
+	if cfg.Method, cfg.Password, found = strings.Cut(string(userInfo), ":"); !found {
+		return cfg, errors.New("shadowsocks user info has no password")
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,300 @@
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// echoHandler records the requested destination, writes the banner and echoes the payload
+type echoHandler struct {
+	destinations chan string
+	banner       string
+}
+
+func (h *echoHandler) NewConnection(_ context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.destinations <- metadata.Destination.String()
+	if h.banner != "" {
+		if _, err := conn.Write([]byte(h.banner)); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+func (h *echoHandler) NewPacketConnection(context.Context, N.PacketConn, M.Metadata) error {
+	return nil
+}
+
+func (h *echoHandler) NewError(context.Context, error) {}
+
+func shadowsocksKey(t *testing.T, size int) string {
+	t.Helper()
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// shadowsocksServer serves the method on a local listener and returns its address
+func shadowsocksServer(t *testing.T, method, password string, handler *echoHandler) string {
+	t.Helper()
+
+	var (
+		service N.TCPConnectionHandler
+		err     error
+	)
+
+	if strings.HasPrefix(method, "2022-") {
+		service, err = shadowaead_2022.NewServiceWithPassword(method, password, 60, handler, time.Now)
+	} else {
+		service, err = shadowaead.NewService(method, nil, password, 60, handler)
+	}
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	return serveShadowsocks(t, service)
+}
+
+// serveShadowsocks accepts connections for the service on a local listener
+func serveShadowsocks(t *testing.T, service N.TCPConnectionHandler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = service.NewConnection(context.Background(), conn, M.Metadata{})
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func shadowsocksClient(t *testing.T, address, method, password string) *Shadowsocks {
+	t.Helper()
+
+	ss := NewShadowsocks(config.ShadowsocksConfig{
+		Address:  address,
+		Method:   method,
+		Password: password,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err := ss.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	return ss
+}
+
+func TestShadowsocks(t *testing.T) {
+	identityKey := shadowsocksKey(t, 32)
+	userKey := shadowsocksKey(t, 32)
+
+	for _, tc := range []struct {
+		name      string
+		method    string
+		password  string
+		multiUser bool
+	}{
+		{name: "aes-128-gcm", method: "aes-128-gcm", password: "secret"},
+		{name: "aes-256-gcm", method: "aes-256-gcm", password: "secret"},
+		{name: "chacha20-ietf-poly1305", method: "chacha20-ietf-poly1305", password: "secret"},
+		{name: "2022-blake3-aes-128-gcm", method: "2022-blake3-aes-128-gcm", password: shadowsocksKey(t, 16)},
+		{name: "2022-blake3-aes-256-gcm", method: "2022-blake3-aes-256-gcm", password: shadowsocksKey(t, 32)},
+		{name: "2022-blake3-chacha20-poly1305", method: "2022-blake3-chacha20-poly1305", password: shadowsocksKey(t, 32)},
+		// the client sends the identity header of a multi-user server
+		{name: "2022 multi-user", method: "2022-blake3-aes-256-gcm", password: identityKey + ":" + userKey, multiUser: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &echoHandler{destinations: make(chan string, 1)}
+
+			var address string
+			if tc.multiUser {
+				service, err := shadowaead_2022.NewMultiServiceWithPassword[string](tc.method, identityKey, 60, handler, time.Now)
+				if err != nil {
+					t.Fatalf("failed to create service: %v", err)
+				}
+				if err = service.UpdateUsersWithPasswords([]string{"user"}, []string{userKey}); err != nil {
+					t.Fatal(err)
+				}
+				address = serveShadowsocks(t, service)
+			} else {
+				address = shadowsocksServer(t, tc.method, tc.password, handler)
+			}
+
+			conn, err := shadowsocksClient(t, address, tc.method, tc.password).Connect("example.com", 443, time.Second)
+			if err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+
+			reply := make([]byte, 4)
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if string(reply) != "ping" {
+				t.Errorf("got %q, want: %q", reply, "ping")
+			}
+
+			if destination := <-handler.destinations; destination != "example.com:443" {
+				t.Errorf("got destination %s, want: example.com:443", destination)
+			}
+		})
+	}
+}
+
+// TestShadowsocksServerFirst reads without writing, like the client of an smtp or ssh server,
+// the header is flushed on its own so the server learns the destination and greets
+func TestShadowsocksServerFirst(t *testing.T) {
+	const banner = "SSH-2.0-OpenSSH_9.6\r\n"
+
+	for _, tc := range []struct {
+		method   string
+		password string
+	}{
+		{"aes-256-gcm", "secret"},
+		{"2022-blake3-aes-256-gcm", shadowsocksKey(t, 32)},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			handler := &echoHandler{destinations: make(chan string, 1), banner: banner}
+			address := shadowsocksServer(t, tc.method, tc.password, handler)
+
+			conn, err := shadowsocksClient(t, address, tc.method, tc.password).Connect("example.com", 22, time.Second)
+			if err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+			defer conn.Close()
+
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+			reply := make([]byte, len(banner))
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if string(reply) != banner {
+				t.Errorf("got %q, want: %q", reply, banner)
+			}
+
+			if destination := <-handler.destinations; destination != "example.com:22" {
+				t.Errorf("got destination %s, want: example.com:22", destination)
+			}
+		})
+	}
+}
+
+// TestShadowsocksHeaderWithPayload checks that a write before the delay still carries the header,
+// the timer must not send a second one
+func TestShadowsocksHeaderWithPayload(t *testing.T) {
+	handler := &echoHandler{destinations: make(chan string, 1)}
+	address := shadowsocksServer(t, "aes-256-gcm", "secret", handler)
+
+	conn, err := shadowsocksClient(t, address, "aes-256-gcm", "secret").Connect("example.com", 443, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	// after the delay the stream must still decode, a second header would corrupt it
+	time.Sleep(2 * shadowsocksHeaderDelay)
+
+	if _, err = conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(reply) != "pingpong" {
+		t.Errorf("got %q, want: %q", reply, "pingpong")
+	}
+}
+
+func TestShadowsocksWrongPassword(t *testing.T) {
+	handler := &echoHandler{destinations: make(chan string, 1)}
+	address := shadowsocksServer(t, "2022-blake3-aes-256-gcm", shadowsocksKey(t, 32), handler)
+
+	// a 2022 server authenticates the header with the key, the destination is never seen
+	conn, err := shadowsocksClient(t, address, "2022-blake3-aes-256-gcm", shadowsocksKey(t, 32)).Connect("example.com", 443, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 4)); err == nil {
+		t.Error("expected the server to reject the key")
+	}
+	if len(handler.destinations) != 0 {
+		t.Error("the server accepted a request with the wrong key")
+	}
+}
+
+func TestParseShadowsocksLink(t *testing.T) {
+	for link, want := range map[string]config.ShadowsocksConfig{
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388#name": {
+			Address: "203.0.113.1:8388", Method: "aes-256-gcm", Password: "secret",
+		},
+		"ss://2022-blake3-aes-128-gcm:a2V5%3A@[2001:db8::1]:8388/?#name": {
+			Address: "[2001:db8::1]:8388", Method: "2022-blake3-aes-128-gcm", Password: "a2V5:",
+		},
+	} {
+		got, err := ParseShadowsocksLink(link)
+		if err != nil {
+			t.Fatalf("%s: ParseShadowsocksLink() error: %v", link, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want: %+v", link, got, want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1",
+		"ss://YWVzLTI1Ni1nY20@203.0.113.1:8388",
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388/?plugin=obfs-local",
+	} {
+		if _, err := ParseShadowsocksLink(invalid); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
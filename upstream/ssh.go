@@ -2,62 +2,110 @@ package upstream
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 )
 
 type SSH struct {
-	config config.SSHConfig
+	config   config.SSHConfig
+	outbound *dialer.Outbound
+
+	authMethods []ssh.AuthMethod
 }
 
-func NewSSH(config config.SSHConfig) *SSH {
-	return &SSH{config: config}
+func NewSSH(config config.SSHConfig, outbound *dialer.Outbound) *SSH {
+	return &SSH{
+		config:   config,
+		outbound: outbound,
+	}
 }
 
-func (*SSH) Init() error {
-	return nil
+func (s *SSH) Init() error {
+	var errs []error
+
+	if err := validateAddress(s.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	if s.config.User == "" {
+		errs = append(errs, errors.New("user is empty"))
+	}
+
+	if signer, err := s.parsePrivateKey(); err != nil {
+		errs = append(errs, err)
+	} else {
+		s.authMethods = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	}
+
+	return errors.Join(errs...)
 }
 
-func (s *SSH) Connect(sni string, timeout time.Duration) (net.Conn, error) {
-	var authMethods []ssh.AuthMethod
+func (s *SSH) parsePrivateKey() (ssh.Signer, error) {
+	if s.config.PrivateKey == "" {
+		return nil, errors.New("private key is empty")
+	}
 
-	if s.config.PrivateKey != "" {
-		privateKey, err := base64.StdEncoding.DecodeString(s.config.PrivateKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to base64 decode private key: %w", err)
-		}
+	privateKey, err := base64.StdEncoding.DecodeString(s.config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to base64 decode private key: %w", err)
+	}
 
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse private key: %v", err)
-		}
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
 
+	return signer, nil
+}
+
+func (s *SSH) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
 	sshConfig := &ssh.ClientConfig{
 		User:            s.config.User,
-		Auth:            authMethods,
+		Auth:            s.authMethods,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		Timeout:         timeout,
 	}
 
 	// connect to ssh server
-	sshClient, err := ssh.Dial("tcp", s.config.Address, sshConfig)
+	d := s.outbound.Dialer()
+	d.Timeout = timeout
+
+	tcpConn, err := d.Dial("tcp", s.config.Address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial ssh server: %v", err)
 	}
 
+	// the handshake and opening the channel share the timeout, a server that stops answering does not hang the connection
+	if err = tcpConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, s.config.Address, sshConfig)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("failed to establish ssh connection: %v", err)
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+
 	// create a tunnel through ssh
-	conn, err := sshClient.Dial("tcp", net.JoinHostPort(sni, "443"))
+	conn, err := sshClient.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
 	if err != nil {
+		sshClient.Close()
 		return nil, fmt.Errorf("failed to dial through ssh tunnel: %v", err)
 	}
 
+	// reset deadline to no deadline
+	_ = tcpConn.SetDeadline(time.Time{})
+
 	return conn, nil
 }
 
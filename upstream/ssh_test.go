@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+func TestSSHHandshakeTimeout(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server accepts the connection and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	s := NewSSH(config.SSHConfig{
+		Address:    ln.Addr().String(),
+		User:       "test",
+		PrivateKey: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block)),
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+	if err = s.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	start := time.Now()
+
+	if _, err = s.Connect("example.com", 443, 200*time.Millisecond); err == nil {
+		t.Fatal("expected error from a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connect() took %s, want the 200ms timeout", elapsed)
+	}
+}
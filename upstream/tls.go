@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsHandshake runs a plain tls handshake, or a utls one when a fingerprint is set
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config, fingerprint *utls.ClientHelloID) (net.Conn, error) {
+	if fingerprint == nil {
+		tlsConn := tls.Client(conn, config)
+		return tlsConn, tlsConn.HandshakeContext(ctx)
+	}
+
+	uConfig := &utls.Config{
+		ServerName: config.ServerName,
+		NextProtos: config.NextProtos,
+		RootCAs:    config.RootCAs,
+	}
+
+	// without alpn the preset is sent as is, the golang fingerprint has no spec and sends the alpn on its own
+	spec, ok := fingerprintSpec(*fingerprint, config.NextProtos)
+	if !ok {
+		uConn := utls.UClient(conn, uConfig, *fingerprint)
+		return uConn, uConn.HandshakeContext(ctx)
+	}
+
+	uConn := utls.UClient(conn, uConfig, utls.HelloCustom)
+	if err := uConn.ApplyPreset(spec); err != nil {
+		return nil, fmt.Errorf("failed to apply fingerprint: %w", err)
+	}
+
+	return uConn, uConn.HandshakeContext(ctx)
+}
+
+// negotiatedProtocol returns the alpn protocol of a connection from tlsHandshake
+func negotiatedProtocol(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().NegotiatedProtocol
+	case *utls.UConn:
+		return c.ConnectionState().NegotiatedProtocol
+	}
+
+	return ""
+}
+
+// fingerprintSpec returns the ClientHello of the fingerprint offering the given alpn protocols,
+// the presets would otherwise send the protocols of the browser they mimic
+func fingerprintSpec(fingerprint utls.ClientHelloID, alpn []string) (*utls.ClientHelloSpec, bool) {
+	if len(alpn) == 0 {
+		return nil, false
+	}
+
+	spec, err := utls.UTLSIdToSpec(fingerprint)
+	if err != nil {
+		return nil, false
+	}
+
+	i := slices.IndexFunc(spec.Extensions, func(ext utls.TLSExtension) bool {
+		_, ok := ext.(*utls.ALPNExtension)
+		return ok
+	})
+	if i < 0 {
+		spec.Extensions = append(spec.Extensions, &utls.ALPNExtension{AlpnProtocols: alpn})
+	} else {
+		spec.Extensions[i] = &utls.ALPNExtension{AlpnProtocols: alpn}
+	}
+
+	return &spec, true
+}
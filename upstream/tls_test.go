@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+)
+
+func TestTLSHandshakeALPN(t *testing.T) {
+	cert, pool := testCertificate(t, "alpn.test")
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	for _, tc := range []struct {
+		fingerprint string
+		alpn        []string
+		want        string
+	}{
+		// the preset offers h2 first
+		{"chrome", nil, "h2"},
+		{"chrome", []string{"http/1.1"}, "http/1.1"},
+		{"firefox", []string{"http/1.1"}, "http/1.1"},
+		{"hellogolang", []string{"http/1.1"}, "http/1.1"},
+		{"", []string{"http/1.1"}, "http/1.1"},
+	} {
+		tcpConn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		config := &tls.Config{ServerName: "alpn.test", NextProtos: tc.alpn, RootCAs: pool}
+		fingerprint := xtls.GetFingerprint(tc.fingerprint)
+		if tc.fingerprint == "" {
+			fingerprint = nil
+		}
+
+		conn, err := tlsHandshake(ctx, tcpConn, config, fingerprint)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s %v: tlsHandshake() error: %v", tc.fingerprint, tc.alpn, err)
+		}
+
+		if got := negotiatedProtocol(conn); got != tc.want {
+			t.Errorf("%s %v: got protocol %q, want: %q", tc.fingerprint, tc.alpn, got, tc.want)
+		}
+
+		conn.Close()
+	}
+}
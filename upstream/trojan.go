@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+type Trojan struct {
+	config   config.TrojanConfig
+	outbound *dialer.Outbound
+
+	// hex encoded sha224 of the password
+	passwordHash []byte
+	tlsConfig    *tls.Config
+	fingerprint  *utls.ClientHelloID
+}
+
+func NewTrojan(config config.TrojanConfig, outbound *dialer.Outbound) *Trojan {
+	return &Trojan{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (t *Trojan) Init() error {
+	var errs []error
+
+	if err := validateAddress(t.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	if t.config.Password == "" {
+		errs = append(errs, errors.New("password is empty"))
+	}
+
+	if t.config.Fingerprint != "" {
+		if err := validateFingerprint(t.config.Fingerprint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	hash := sha256.Sum224([]byte(t.config.Password))
+	t.passwordHash = hex.AppendEncode(nil, hash[:])
+
+	serverName := t.config.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(t.config.Address)
+	}
+
+	t.tlsConfig = &tls.Config{
+		ServerName: serverName,
+		NextProtos: t.config.ALPN,
+	}
+
+	if t.config.Fingerprint != "" {
+		t.fingerprint = xtls.GetFingerprint(t.config.Fingerprint)
+	}
+
+	return nil
+}
+
+func (t *Trojan) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	d := t.outbound.Dialer()
+	d.Timeout = timeout
+
+	tcpConn, err := d.Dial("tcp", t.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial trojan server: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := tlsHandshake(ctx, tcpConn, t.tlsConfig, t.fingerprint)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	if err = conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	request, err := t.trojanRequest(host, port)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to encode trojan request: %w", err)
+	}
+
+	// the server sends no response, data follows the request directly
+	if _, err = conn.Write(request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write trojan request: %w", err)
+	}
+
+	// reset deadline
+	if err = conn.SetWriteDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to reset write deadline: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (t *Trojan) trojanRequest(host string, port uint16) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(t.passwordHash)
+	buf.WriteString("\r\n")
+
+	buf.WriteByte(1) // connect
+
+	if addr, err := netip.ParseAddr(host); err != nil {
+		buf.WriteByte(3) // domain
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	} else if addr.Is4() {
+		buf.WriteByte(1) // ipv4
+		buf.Write(addr.AsSlice())
+	} else {
+		buf.WriteByte(4) // ipv6
+		buf.Write(addr.AsSlice())
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, port); err != nil {
+		return nil, fmt.Errorf("failed to write port number: %w", err)
+	}
+
+	buf.WriteString("\r\n")
+
+	return buf.Bytes(), nil
+}
+
+func (t *Trojan) Close() error {
+	return nil
+}
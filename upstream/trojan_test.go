@@ -0,0 +1,189 @@
+package upstream
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// testCertificate returns a self-signed certificate for the given name
+func testCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	certificate, cert, err := generateCertificate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certificate, pool
+}
+
+// trojanServer is a minimal trojan server that checks the request and echoes the payload
+func trojanServer(conn net.Conn, password string, targets chan<- string) error {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	hash := sha256.Sum224([]byte(password))
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != hex.EncodeToString(hash[:])+"\r\n" {
+		return errors.New("wrong password hash")
+	}
+
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != 1 {
+		return fmt.Errorf("unexpected command %d", header[0])
+	}
+
+	var host string
+
+	switch header[1] {
+	case 1, 4:
+		addr := make([]byte, 4)
+		if header[1] == 4 {
+			addr = make([]byte, 16)
+		}
+		if _, err = io.ReadFull(reader, addr); err != nil {
+			return err
+		}
+		host = net.IP(addr).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		domain := make([]byte, length)
+		if _, err = io.ReadFull(reader, domain); err != nil {
+			return err
+		}
+		host = string(domain)
+	default:
+		return fmt.Errorf("unexpected address type %d", header[1])
+	}
+
+	rest := make([]byte, 4)
+	if _, err = io.ReadFull(reader, rest); err != nil {
+		return err
+	}
+	if string(rest[2:]) != "\r\n" {
+		return errors.New("missing request terminator")
+	}
+
+	targets <- net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(rest)))
+
+	_, err = io.Copy(conn, reader)
+	return err
+}
+
+func TestTrojanRequest(t *testing.T) {
+	trojan := NewTrojan(config.TrojanConfig{Address: "trojan.test:443", Password: "secret"}, nil)
+	if err := trojan.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	hash := sha256.Sum224([]byte("secret"))
+	prefix := hex.EncodeToString(hash[:]) + "\r\n\x01"
+
+	// connect command, socks address type, address, port and crlf
+	for _, tc := range []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"example.com", 443, "\x03\x0bexample.com\x01\xbb\r\n"},
+		{"192.0.2.1", 8443, "\x01\xc0\x00\x02\x01\x20\xfb\r\n"},
+		{"2001:db8::1", 853, "\x04\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x03\x55\r\n"},
+	} {
+		request, err := trojan.trojanRequest(tc.host, tc.port)
+		if err != nil {
+			t.Fatalf("%s: trojanRequest() error: %v", tc.host, err)
+		}
+		if string(request) != prefix+tc.want {
+			t.Errorf("%s: got %q, want: %q", tc.host, request, prefix+tc.want)
+		}
+	}
+}
+
+func TestTrojan(t *testing.T) {
+	const password = "secret"
+
+	cert, pool := testCertificate(t, "trojan.test")
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	targets := make(chan string, 1)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = trojanServer(conn, password, targets) }()
+		}
+	}()
+
+	for _, fingerprint := range []string{"", "chrome"} {
+		trojan := NewTrojan(config.TrojanConfig{
+			Address:     ln.Addr().String(),
+			Password:    password,
+			ServerName:  "trojan.test",
+			Fingerprint: fingerprint,
+		}, dialer.NewOutbound(config.OutboundConfig{}))
+
+		if err := trojan.Init(); err != nil {
+			t.Fatalf("Init() error: %v", err)
+		}
+		trojan.tlsConfig.RootCAs = pool
+
+		conn, err := trojan.Connect("example.com", 443, time.Second)
+		if err != nil {
+			t.Fatalf("fingerprint %q: Connect() error: %v", fingerprint, err)
+		}
+
+		// the request is written on connect, before any payload
+		if got := <-targets; got != "example.com:443" {
+			t.Errorf("fingerprint %q: got target %s, want: example.com:443", fingerprint, got)
+		}
+
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+
+		reply := make([]byte, 4)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if string(reply) != "ping" {
+			t.Errorf("got %q, want: %q", reply, "ping")
+		}
+
+		conn.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// validateAddress checks a host:port server address
+func validateAddress(address string) error {
+	if address == "" {
+		return errors.New("address is empty")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		return fmt.Errorf("address %q has no host", address)
+	}
+
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("address %q has an invalid port", address)
+	}
+
+	return nil
+}
+
+// validateFingerprint checks that a tls client fingerprint is known to utls
+func validateFingerprint(name string) error {
+	if tls.GetFingerprint(name) == nil {
+		return fmt.Errorf("unknown tls fingerprint %q", name)
+	}
+
+	return nil
+}
+
+// parseUserID parses a vless user id: a uuid of a defined version,
+// or a short custom string that is mapped to a uuid v5 the way xray-core does it
+func parseUserID(id string) (uuid.UUID, error) {
+	uid, err := uuid.ParseString(id)
+	if err != nil {
+		return uid, fmt.Errorf("uuid: %w", err)
+	}
+
+	if len(id) < 32 {
+		return uid, nil
+	}
+
+	b := uid.Bytes()
+
+	if version := b[6] >> 4; version < 1 || version > 8 {
+		return uid, fmt.Errorf("uuid %q has unknown version %d", id, version)
+	}
+
+	if b[8]>>6 != 0b10 {
+		return uid, fmt.Errorf("uuid %q has an unknown variant", id)
+	}
+
+	return uid, nil
+}
@@ -0,0 +1,235 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// ParseVLESSLink converts a vless:// share link into an upstream config, e.g.
+// vless://uuid@host:port?security=reality&pbk=...&sid=...&sni=...&fp=...&flow=...#name
+// or vless://uuid@host:port?security=tls&type=ws&host=...&path=...&sni=...#name
+func ParseVLESSLink(link string) (config.VLESSRealityConfig, error) {
+	var cfg config.VLESSRealityConfig
+
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid vless link: %w", err)
+	}
+
+	if u.Scheme != "vless" {
+		return cfg, fmt.Errorf("unsupported link scheme: %q", u.Scheme)
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return cfg, errors.New("vless link has no uuid")
+	}
+
+	if u.Port() == "" {
+		return cfg, errors.New("vless link has no port")
+	}
+
+	cfg.UUID = u.User.Username()
+	cfg.Address = u.Host
+	cfg.Transport = config.VLESSTransportTCP
+
+	for key, values := range u.Query() {
+		value := values[0]
+
+		switch key {
+		case "security":
+			cfg.Security = config.VLESSSecurity(value)
+			if cfg.Security != config.VLESSSecurityReality && cfg.Security != config.VLESSSecurityTLS {
+				return cfg, fmt.Errorf("unsupported vless security %q, only reality and tls are supported", value)
+			}
+		case "type":
+			switch value {
+			case "tcp", "raw":
+				cfg.Transport = config.VLESSTransportTCP
+			case "ws", "grpc", "xhttp":
+				cfg.Transport = config.VLESSTransport(value)
+			case "splithttp":
+				cfg.Transport = config.VLESSTransportXHTTP
+			default:
+				return cfg, fmt.Errorf("unsupported vless transport %q", value)
+			}
+		case "encryption":
+			if value != "none" {
+				return cfg, fmt.Errorf("unsupported vless encryption %q", value)
+			}
+		case "headerType":
+			if value != "none" {
+				return cfg, fmt.Errorf("unsupported tcp header type %q", value)
+			}
+		case "spx":
+			if value != "/" {
+				return cfg, fmt.Errorf("unsupported reality spider path %q", value)
+			}
+		case "pbk":
+			cfg.PublicKey = value
+		case "sid":
+			cfg.ShortID = value
+		case "sni":
+			cfg.ServerName = value
+		case "fp":
+			cfg.Fingerprint = value
+		case "flow":
+			cfg.Flow = value
+		case "alpn":
+			cfg.ALPN = strings.Split(value, ",")
+		case "host", "authority":
+			cfg.Host = value
+		case "path", "serviceName":
+			cfg.Path = value
+		case "mode":
+			cfg.Mode = value
+		default:
+			return cfg, fmt.Errorf("unsupported vless link parameter %q", key)
+		}
+	}
+
+	if cfg.Security == "" {
+		return cfg, errors.New("vless link has no security, only reality and tls are supported")
+	}
+
+	return cfg, nil
+}
+
+// VLESSSubscription expands a subscription document into a group of VLESS upstreams
+type VLESSSubscription struct {
+	*Group
+
+	config   config.VLESSRealityConfig
+	outbound *dialer.Outbound
+}
+
+func NewVLESSSubscription(config config.VLESSRealityConfig, outbound *dialer.Outbound) *VLESSSubscription {
+	return &VLESSSubscription{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (s *VLESSSubscription) Init() error {
+	document, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("failed to fetch subscription: %w", err)
+	}
+
+	var members []Upstream
+
+	for i, link := range decodeSubscription(document) {
+		if scheme, _, _ := strings.Cut(link, "://"); scheme != "vless" {
+			slog.Warn("skipping subscription entry, only vless links are supported",
+				slog.Int("entry", i+1), slog.String("scheme", scheme))
+			continue
+		}
+
+		cfg, err := ParseVLESSLink(link)
+		if err != nil {
+			slog.Warn("skipping subscription entry", slog.Int("entry", i+1), slog.Any("error", err))
+			continue
+		}
+		cfg.Mux = s.config.Mux
+
+		// one broken entry does not take down the rest of the subscription
+		member := NewVlessReality(cfg, s.outbound)
+		if err = member.Init(); err != nil {
+			slog.Warn("skipping subscription entry", slog.Int("entry", i+1), slog.Any("error", err))
+			continue
+		}
+
+		members = append(members, member)
+	}
+
+	if len(members) == 0 {
+		return errors.New("subscription has no usable vless links")
+	}
+	slog.Info("loaded subscription", slog.Int("upstreams", len(members)))
+
+	// members are initialized already
+	s.Group = NewGroup(members...)
+
+	return nil
+}
+
+// Validate checks the subscription source without fetching it, the links are only known after that
+func (s *VLESSSubscription) Validate() error {
+	source := s.config.Subscription
+
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		if _, err := os.Stat(source); err != nil {
+			return fmt.Errorf("invalid subscription: %w", err)
+		}
+		return nil
+	}
+
+	// the url is not part of the error, subscription urls carry a token
+	if sourceURL, err := url.Parse(source); err != nil || sourceURL.Host == "" {
+		return errors.New("invalid subscription url")
+	}
+
+	return nil
+}
+
+func (s *VLESSSubscription) fetch() ([]byte, error) {
+	source := s.config.Subscription
+
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: s.outbound.DialContext,
+		},
+	}
+
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status: %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// decodeSubscription returns the links of a base64 encoded or plain text subscription
+func decodeSubscription(document []byte) []string {
+	document = bytes.TrimSpace(document)
+
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if decoded, err := encoding.DecodeString(string(document)); err == nil {
+			document = decoded
+			break
+		}
+	}
+
+	var links []string
+
+	for line := range strings.Lines(string(document)) {
+		if line = strings.TrimSpace(line); line != "" {
+			links = append(links, line)
+		}
+	}
+
+	return links
+}
@@ -0,0 +1,134 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+func TestParseVLESSLink(t *testing.T) {
+	const link = "vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1:443" +
+		"?security=reality&encryption=none&type=tcp&pbk=pubkey&sid=ab12&sni=example.com&fp=firefox" +
+		"&flow=xtls-rprx-vision#my%20server"
+
+	got, err := ParseVLESSLink(link)
+	if err != nil {
+		t.Fatalf("ParseVLESSLink() error: %v", err)
+	}
+
+	want := config.VLESSRealityConfig{
+		Address:     "203.0.113.1:443",
+		UUID:        "0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d",
+		ShortID:     "ab12",
+		PublicKey:   "pubkey",
+		ServerName:  "example.com",
+		Fingerprint: "firefox",
+		Flow:        "xtls-rprx-vision",
+		Security:    config.VLESSSecurityReality,
+		Transport:   config.VLESSTransportTCP,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want: %+v", got, want)
+	}
+
+	const wsLink = "vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@cdn.example.com:443" +
+		"?security=tls&encryption=none&type=ws&host=ws.example.com&path=%2Fvless&sni=ws.example.com&alpn=h2%2Chttp%2F1.1"
+
+	got, err = ParseVLESSLink(wsLink)
+	if err != nil {
+		t.Fatalf("ParseVLESSLink() error: %v", err)
+	}
+
+	want = config.VLESSRealityConfig{
+		Address:    "cdn.example.com:443",
+		UUID:       "0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d",
+		ServerName: "ws.example.com",
+		Security:   config.VLESSSecurityTLS,
+		Transport:  config.VLESSTransportWebSocket,
+		ALPN:       []string{"h2", "http/1.1"},
+		Host:       "ws.example.com",
+		Path:       "/vless",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want: %+v", got, want)
+	}
+
+	for _, invalid := range []string{
+		"vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1:443?security=none",
+		"vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1:443?security=reality&type=kcp",
+		"vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1:443?security=reality&unknown=1",
+		"vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1?security=reality",
+	} {
+		if _, err := ParseVLESSLink(invalid); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestDecodeSubscription(t *testing.T) {
+	plain := "vless://a@203.0.113.1:443?security=reality\n\ntrojan://b@203.0.113.2:443\r\n"
+
+	for _, document := range []string{plain, base64.StdEncoding.EncodeToString([]byte(plain))} {
+		links := decodeSubscription([]byte(document))
+		if len(links) != 2 {
+			t.Errorf("got %d links, want: 2", len(links))
+		}
+	}
+}
+
+func TestVLESSSubscription(t *testing.T) {
+	const (
+		valid = "vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.1:443" +
+			"?security=reality&type=tcp&pbk=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA&sid=ab12&sni=example.com"
+		// parses, but the public key is rejected by Init
+		invalid = "vless://0b9a3b1e-5bbf-4c3a-9d8e-3f6e8a1f2c4d@203.0.113.2:443" +
+			"?security=reality&type=tcp&pbk=pubkey&sid=ab12&sni=example.com"
+		trojan = "trojan://secret@203.0.113.3:443"
+	)
+
+	subscription := func(links ...string) *VLESSSubscription {
+		path := filepath.Join(t.TempDir(), "subscription")
+		if err := os.WriteFile(path, []byte(strings.Join(links, "\n")), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		return NewVLESSSubscription(config.VLESSRealityConfig{Subscription: path}, dialer.NewOutbound(config.OutboundConfig{}))
+	}
+
+	s := subscription(valid, invalid, trojan)
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	if len(s.members) != 1 {
+		t.Errorf("got %d members, want: 1", len(s.members))
+	}
+
+	if err := subscription(invalid, trojan).Init(); err == nil {
+		t.Error("expected error for a subscription without usable links")
+	}
+}
+
+func TestVLESSSubscriptionValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscription")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for source, valid := range map[string]bool{
+		path:                                   true,
+		"https://sub.example.com/link?token=1": true,
+		path + ".missing":                      false,
+		"https:///link":                        false,
+	} {
+		s := NewVLESSSubscription(config.VLESSRealityConfig{Subscription: source}, dialer.NewOutbound(config.OutboundConfig{}))
+		if err := s.Validate(); (err == nil) != valid {
+			t.Errorf("%s: got error %v, want valid: %v", source, err, valid)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/mux"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/net/cnc"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// vlessMux carries proxied connections as Mux.Cool sessions over a few vless connections,
+// a connection takes new sessions until it is full, retired or closed after being idle
+type vlessMux struct {
+	strategy    mux.ClientStrategy
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+
+	// dial opens a vless connection with the mux command
+	dial func(timeout time.Duration) (net.Conn, error)
+
+	mu      sync.Mutex
+	workers []*muxWorker
+	// dials in progress, sessions wait for them instead of dialing connections of their own
+	dials  []*muxDial
+	closed bool
+}
+
+// vlessMuxMaxIdleTimeout is the interval at which xray-core closes idle connections on its own
+const vlessMuxMaxIdleTimeout = 16 * time.Second
+
+type muxWorker struct {
+	*mux.ClientWorker
+	created time.Time
+}
+
+// muxDial is a connection being dialed, sessions reserve their slot on it while holding the lock
+type muxDial struct {
+	done     chan struct{}
+	sessions uint32
+
+	worker *muxWorker
+	err    error
+}
+
+func newVLESSMux(concurrency, maxReuse uint32, maxLifetime, idleTimeout time.Duration, dial func(time.Duration) (net.Conn, error)) *vlessMux {
+	return &vlessMux{
+		strategy: mux.ClientStrategy{
+			MaxConcurrency: concurrency,
+			MaxConnection:  maxReuse,
+		},
+		maxLifetime: maxLifetime,
+		idleTimeout: idleTimeout,
+		dial:        dial,
+	}
+}
+
+func (m *vlessMux) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	target := xnet.TCPDestination(xnet.ParseAddress(host), xnet.Port(port))
+	ctx := session.ContextWithOutbounds(context.Background(), []*session.Outbound{{Target: target}})
+
+	// a worker can fill up between picking and dispatching
+	for range 16 {
+		worker, err := m.pick(timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		uplinkReader, uplinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+		downlinkReader, downlinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+
+		if worker.Dispatch(ctx, &transport.Link{Reader: uplinkReader, Writer: downlinkWriter}) {
+			return cnc.NewConnection(cnc.ConnectionInputMulti(uplinkWriter), cnc.ConnectionOutputMulti(downlinkReader)), nil
+		}
+	}
+
+	return nil, errors.New("no mux connection available")
+}
+
+// pick returns a worker with room for another session, dialing a new one if needed
+func (m *vlessMux) pick(timeout time.Duration) (*muxWorker, error) {
+	m.mu.Lock()
+
+	if m.closed {
+		m.mu.Unlock()
+		return nil, errors.New("mux is closed")
+	}
+
+	m.workers = slices.DeleteFunc(m.workers, func(w *muxWorker) bool { return w.Closed() })
+
+	for _, worker := range m.workers {
+		if worker.IsFull() || m.maxLifetime > 0 && time.Since(worker.created) > m.maxLifetime {
+			continue
+		}
+		m.mu.Unlock()
+		return worker, nil
+	}
+
+	for _, d := range m.dials {
+		if d.sessions < m.strategy.MaxConcurrency {
+			d.sessions++
+			m.mu.Unlock()
+
+			<-d.done
+			return d.worker, d.err
+		}
+	}
+
+	d := &muxDial{done: make(chan struct{}), sessions: 1}
+	m.dials = append(m.dials, d)
+	m.mu.Unlock()
+
+	// the dial can take as long as the timeout, other sessions are not held up by it
+	d.worker, d.err = m.newWorker(timeout)
+
+	m.mu.Lock()
+	m.dials = slices.DeleteFunc(m.dials, func(other *muxDial) bool { return other == d })
+	if d.err == nil {
+		if m.closed {
+			_ = d.worker.Close()
+			d.worker, d.err = nil, errors.New("mux is closed")
+		} else {
+			m.workers = append(m.workers, d.worker)
+		}
+	}
+	m.mu.Unlock()
+
+	close(d.done)
+
+	return d.worker, d.err
+}
+
+func (m *vlessMux) newWorker(timeout time.Duration) (*muxWorker, error) {
+	conn, err := m.dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// frames of all sessions are serialized through the uplink pipe
+	uplinkReader, uplinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+	downlinkReader, downlinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+
+	worker, err := mux.NewClientWorker(transport.Link{Reader: downlinkReader, Writer: uplinkWriter}, m.strategy)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		_ = buf.Copy(uplinkReader, buf.NewWriter(conn))
+		conn.Close()
+	}()
+	go func() {
+		_ = buf.Copy(buf.NewReader(conn), downlinkWriter)
+		_ = downlinkWriter.Close()
+	}()
+	go func() {
+		<-worker.WaitClosed()
+		conn.Close()
+	}()
+
+	if m.idleTimeout > 0 {
+		go m.closeIdle(worker)
+	}
+
+	return &muxWorker{ClientWorker: worker, created: time.Now()}, nil
+}
+
+// closeIdle closes the worker once it went a full idle timeout without sessions, like xray-core
+// does on its own at vlessMuxMaxIdleTimeout
+func (m *vlessMux) closeIdle(worker *mux.ClientWorker) {
+	ticker := time.NewTicker(m.idleTimeout)
+	defer ticker.Stop()
+
+	total := worker.TotalConnections()
+
+	for {
+		select {
+		case <-worker.WaitClosed():
+			return
+		case <-ticker.C:
+		}
+
+		if worker.ActiveConnections() == 0 && worker.TotalConnections() == total {
+			_ = worker.Close()
+			return
+		}
+		total = worker.TotalConnections()
+	}
+}
+
+func (m *vlessMux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+
+	for _, worker := range m.workers {
+		_ = worker.Close()
+	}
+	m.workers = nil
+
+	return nil
+}
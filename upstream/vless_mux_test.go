@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/mux"
+	"github.com/xtls/xray-core/common/protocol"
+)
+
+// muxEchoServer answers every mux session by echoing its data
+func muxEchoServer(conn net.Conn) {
+	defer conn.Close()
+
+	reader := &buf.BufferedReader{Reader: buf.NewReader(conn)}
+	writer := buf.NewWriter(conn)
+
+	var meta mux.FrameMetadata
+	for {
+		if err := meta.Unmarshal(reader, false); err != nil {
+			return
+		}
+
+		if !meta.Option.Has(mux.OptionData) {
+			continue
+		}
+
+		data, err := mux.NewStreamReader(reader).ReadMultiBuffer()
+		if err != nil {
+			return
+		}
+
+		if meta.SessionStatus == mux.SessionStatusEnd {
+			buf.ReleaseMulti(data)
+			continue
+		}
+
+		if err := mux.NewResponseWriter(meta.SessionID, writer, protocol.TransferTypeStream).WriteMultiBuffer(data); err != nil {
+			return
+		}
+	}
+}
+
+func TestVLESSMux(t *testing.T) {
+	var dials atomic.Int32
+
+	m := newVLESSMux(2, 128, 0, 0, func(time.Duration) (net.Conn, error) {
+		dials.Add(1)
+
+		client, server := net.Pipe()
+		go muxEchoServer(server)
+
+		return client, nil
+	})
+	defer m.Close()
+
+	for i := range 3 {
+		conn, err := m.Connect("example.com", 443, time.Second)
+		if err != nil {
+			t.Fatalf("Connect() error: %v", err)
+		}
+		defer conn.Close()
+
+		message := []byte{'a' + byte(i)}
+		if _, err := conn.Write(message); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+
+		reply := make([]byte, 1)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if reply[0] != message[0] {
+			t.Errorf("got %q, want: %q", reply, message)
+		}
+	}
+
+	// two sessions share the first connection, the third needs another one
+	if got := dials.Load(); got != 2 {
+		t.Errorf("got %d dials, want: 2", got)
+	}
+}
+
+func TestVLESSMuxConcurrentDial(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+
+	m := newVLESSMux(2, 128, 0, 0, func(time.Duration) (net.Conn, error) {
+		dials.Add(1)
+		<-release
+
+		client, server := net.Pipe()
+		go muxEchoServer(server)
+
+		return client, nil
+	})
+	defer m.Close()
+
+	workers := make(chan *muxWorker, 3)
+	for range 3 {
+		go func() {
+			worker, err := m.pick(time.Second)
+			if err != nil {
+				t.Errorf("pick() error: %v", err)
+			}
+			workers <- worker
+		}()
+	}
+
+	// the slow dials do not hold the lock, two sessions share the first dial
+	// and the third one needs a connection of its own
+	reserved := func() (dials int, sessions uint32) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, d := range m.dials {
+			sessions += d.sessions
+		}
+
+		return len(m.dials), sessions
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if pending, sessions := reserved(); sessions == 3 {
+			if pending != 2 {
+				t.Errorf("got %d dials in progress, want: 2", pending)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sessions did not reserve their slots")
+		}
+	}
+
+	close(release)
+
+	distinct := make(map[*muxWorker]int)
+	for range 3 {
+		distinct[<-workers]++
+	}
+	if len(distinct) != 2 || dials.Load() != 2 {
+		t.Errorf("got %d workers from %d dials, want: 2 from 2", len(distinct), dials.Load())
+	}
+}
+
+func TestVLESSMuxIdleTimeout(t *testing.T) {
+	m := newVLESSMux(2, 128, 0, 50*time.Millisecond, func(time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go muxEchoServer(server)
+
+		return client, nil
+	})
+	defer m.Close()
+
+	worker, err := m.pick(time.Second)
+	if err != nil {
+		t.Fatalf("pick() error: %v", err)
+	}
+
+	select {
+	case <-worker.WaitClosed():
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
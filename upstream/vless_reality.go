@@ -3,125 +3,212 @@ package upstream
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"time"
 
 	xnet "github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/common/uuid"
-	"github.com/xtls/xray-core/transport/internet/reality"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vless/encoding"
+	"github.com/xtls/xray-core/transport/internet"
+	"google.golang.org/protobuf/proto"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 )
 
+// VLESSReality connects through a vless server, by default over raw tcp with reality,
+// the security and transport layers are configurable
 type VLESSReality struct {
-	config config.VLESSRealityConfig
-}
+	config   config.VLESSRealityConfig
+	outbound *dialer.Outbound
+
+	uid            uuid.UUID
+	dest           xnet.Destination
+	streamSettings *internet.MemoryStreamConfig
 
-func NewVlessReality(config config.VLESSRealityConfig) *VLESSReality {
-	return &VLESSReality{config: config}
+	// set when connections are multiplexed
+	mux *vlessMux
 }
 
-func (*VLESSReality) Init() error {
-	return nil
+// vless request commands
+const (
+	vlessCommandTCP byte = 1
+	vlessCommandMux byte = 3
+)
+
+func NewVlessReality(config config.VLESSRealityConfig, outbound *dialer.Outbound) *VLESSReality {
+	return &VLESSReality{
+		config:   config,
+		outbound: outbound,
+	}
 }
 
-func (v *VLESSReality) Connect(sni string, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", v.config.Address, timeout)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial tcp: %w", err)
+func (v *VLESSReality) Init() error {
+	if v.config.URL != "" {
+		cfg, err := ParseVLESSLink(v.config.URL)
+		if err != nil {
+			return err
+		}
+		cfg.Mux = v.config.Mux
+		v.config = cfg
 	}
 
-	realityConn, err := v.realityHandshake(conn, timeout)
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("reality handshake failed: %w", err)
+	var errs []error
+
+	switch v.config.Flow {
+	case "":
+	case vless.XRV:
+		if v.config.Security != config.VLESSSecurityReality || v.config.Transport != config.VLESSTransportTCP {
+			errs = append(errs, fmt.Errorf("flow %s requires the tcp transport with reality", v.config.Flow))
+		}
+
+		if v.config.Mux.Concurrency > 0 {
+			errs = append(errs, fmt.Errorf("mux can not be used with flow %s", v.config.Flow))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported vless flow: %s", v.config.Flow))
 	}
 
-	if err = realityConn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-		realityConn.Close()
-		return nil, fmt.Errorf("failed to set write deadline: %w", err)
+	if v.config.Mux.IdleTimeout > vlessMuxMaxIdleTimeout {
+		errs = append(errs, fmt.Errorf("mux idle timeout can be at most %s", vlessMuxMaxIdleTimeout))
 	}
 
-	if err = v.writeVlessRequest(realityConn, sni); err != nil {
-		realityConn.Close()
-		return nil, fmt.Errorf("failed to write vless request: %w", err)
+	if err := validateAddress(v.config.Address); err != nil {
+		errs = append(errs, err)
+	} else if v.dest, err = xnet.ParseDestination("tcp:" + v.config.Address); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse destination: %w", err))
 	}
 
-	// reset deadline
-	if err = realityConn.SetWriteDeadline(time.Time{}); err != nil {
-		realityConn.Close()
-		return nil, fmt.Errorf("failed to reset write deadline: %w", err)
+	var err error
+
+	if v.uid, err = parseUserID(v.config.UUID); err != nil {
+		errs = append(errs, err)
+	}
+
+	if v.streamSettings, err = streamSettings(v.config); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	useOutbound(v.outbound)
+
+	if v.config.Mux.Concurrency > 0 {
+		v.mux = newVLESSMux(v.config.Mux.Concurrency, v.config.Mux.MaxReuse, v.config.Mux.MaxLifetime, v.config.Mux.IdleTimeout,
+			func(timeout time.Duration) (net.Conn, error) {
+				return v.dial(vlessCommandMux, "", 0, timeout)
+			})
 	}
 
-	return &VLESSConn{Conn: realityConn}, nil
+	return nil
 }
 
-func (v *VLESSReality) realityHandshake(conn net.Conn, timeout time.Duration) (net.Conn, error) {
-	shortID, err := hex.DecodeString(v.config.ShortID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode short id: %w", err)
+func (v *VLESSReality) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	if v.mux != nil {
+		return v.mux.Connect(host, port, timeout)
 	}
 
-	publicKey, err := base64.RawURLEncoding.DecodeString(v.config.PublicKey)
+	return v.dial(vlessCommandTCP, host, port, timeout)
+}
+
+func (v *VLESSReality) dial(command byte, host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	// grpc and xhttp bind their streams to the context, so it lives as long as the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(timeout, cancel)
+
+	conn, err := internet.Dial(ctx, v.dest, v.streamSettings)
+	timer.Stop()
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode public key: %w", err)
+		cancel()
+		return nil, fmt.Errorf("failed to dial %s: %w", v.config.Transport, err)
 	}
 
-	cfg := &reality.Config{
-		Show:        false,
-		Fingerprint: v.config.Fingerprint,
-		ServerName:  v.config.ServerName,
-		ShortId:     shortID,
-		PublicKey:   publicKey,
+	vlessConn := &VLESSConn{Conn: conn, cancel: cancel}
+
+	if err = conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		vlessConn.Close()
+		return nil, fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
-	if cfg.Fingerprint == "" {
-		cfg.Fingerprint = "chrome"
+	header, err := v.vlessRequest(command, host, port)
+	if err != nil {
+		vlessConn.Close()
+		return nil, fmt.Errorf("failed to encode vless request: %w", err)
 	}
 
-	dest, err := xnet.ParseDestination("tcp:" + v.config.Address)
+	if v.config.Flow == vless.XRV {
+		vlessConn.vision, err = newVision(conn, v.uid.Bytes(), header)
+	} else {
+		_, err = conn.Write(header)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse destination: %w", err)
+		vlessConn.Close()
+		return nil, fmt.Errorf("failed to write vless request: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	// reset deadline
+	if err = conn.SetWriteDeadline(time.Time{}); err != nil {
+		vlessConn.Close()
+		return nil, fmt.Errorf("failed to reset write deadline: %w", err)
+	}
 
-	return reality.UClient(conn, cfg, ctx, dest)
+	return vlessConn, nil
 }
 
-func (v *VLESSReality) writeVlessRequest(conn io.Writer, sni string) error {
+func (v *VLESSReality) vlessRequest(command byte, host string, port uint16) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 
 	buf.WriteByte(0) // version
 
-	uid, err := uuid.ParseString(v.config.UUID)
+	buf.Write(v.uid.Bytes())
+
+	// addons, empty unless a flow is set
+	addons, err := proto.Marshal(&encoding.Addons{Flow: v.config.Flow})
 	if err != nil {
-		return fmt.Errorf("failed to parse uuid: %w", err)
+		return nil, fmt.Errorf("failed to marshal addons: %w", err)
 	}
-	buf.Write(uid.Bytes())
+	buf.WriteByte(byte(len(addons)))
+	buf.Write(addons)
 
-	buf.WriteByte(0) // addons
+	buf.WriteByte(command)
 
-	buf.WriteByte(1) // tcp
-	if err = binary.Write(buf, binary.BigEndian, uint16(443)); err != nil {
-		return fmt.Errorf("failed to write port number: %w", err)
+	// mux sessions carry their own destinations
+	if command == vlessCommandMux {
+		return buf.Bytes(), nil
 	}
 
-	buf.WriteByte(2) // sni
-	buf.WriteByte(byte(len(sni)))
-	buf.WriteString(sni)
+	if err = binary.Write(buf, binary.BigEndian, port); err != nil {
+		return nil, fmt.Errorf("failed to write port number: %w", err)
+	}
+
+	if addr, err := netip.ParseAddr(host); err != nil {
+		buf.WriteByte(2) // domain
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	} else if addr.Is4() {
+		buf.WriteByte(1) // ipv4
+		buf.Write(addr.AsSlice())
+	} else {
+		buf.WriteByte(3) // ipv6
+		buf.Write(addr.AsSlice())
+	}
 
-	_, err = conn.Write(buf.Bytes())
-	return err
+	return buf.Bytes(), nil
 }
 
 func (v *VLESSReality) Close() error {
+	if v.mux != nil {
+		return v.mux.Close()
+	}
+
 	return nil
 }
 
@@ -129,6 +216,10 @@ func (v *VLESSReality) Close() error {
 type VLESSConn struct {
 	net.Conn
 	headerRead bool
+	cancel     context.CancelFunc
+
+	// set when the vision flow is used
+	vision *vision
 }
 
 // Read overrides net.Conn.Read to lazily strip the VLESS header
@@ -142,9 +233,30 @@ func (vc *VLESSConn) Read(p []byte) (int, error) {
 		vc.headerRead = true
 	}
 
+	if vc.vision != nil {
+		return vc.vision.Read(p)
+	}
+
 	return vc.Conn.Read(p)
 }
 
+// Write overrides net.Conn.Write to pad traffic when the vision flow is used
+func (vc *VLESSConn) Write(p []byte) (int, error) {
+	if vc.vision != nil {
+		return vc.vision.Write(p)
+	}
+
+	return vc.Conn.Write(p)
+}
+
+func (vc *VLESSConn) Close() error {
+	if vc.cancel != nil {
+		defer vc.cancel()
+	}
+
+	return vc.Conn.Close()
+}
+
 func (vc *VLESSConn) readVlessResponse() error {
 	// buffer for Version(1) + AddonsLen(1)
 	header := make([]byte, 2)
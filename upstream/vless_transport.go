@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/grpc"
+	"github.com/xtls/xray-core/transport/internet/reality"
+	"github.com/xtls/xray-core/transport/internet/splithttp"
+	"github.com/xtls/xray-core/transport/internet/tcp"
+	"github.com/xtls/xray-core/transport/internet/tls"
+	"github.com/xtls/xray-core/transport/internet/websocket"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// streamSettings translates the vless config into the xray-core transport stack:
+// the security layer (tls or reality) and the framing on top of it
+func streamSettings(cfg config.VLESSRealityConfig) (*internet.MemoryStreamConfig, error) {
+	settings := &internet.MemoryStreamConfig{}
+
+	var errs []error
+
+	switch cfg.Security {
+	case config.VLESSSecurityReality:
+		shortID, err := hex.DecodeString(cfg.ShortID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode short id: %w", err))
+		} else if len(shortID) > 8 {
+			errs = append(errs, fmt.Errorf("short id is %d bytes long, at most 8 are allowed", len(shortID)))
+		}
+
+		publicKey, err := base64.RawURLEncoding.DecodeString(cfg.PublicKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to decode public key: %w", err))
+		} else if len(publicKey) != 32 {
+			errs = append(errs, fmt.Errorf("public key is %d bytes long, expected 32", len(publicKey)))
+		}
+
+		if cfg.ServerName == "" {
+			errs = append(errs, errors.New("server name is empty"))
+		}
+
+		realityConfig := &reality.Config{
+			Fingerprint: cfg.Fingerprint,
+			ServerName:  cfg.ServerName,
+			ShortId:     shortID,
+			PublicKey:   publicKey,
+		}
+
+		if realityConfig.Fingerprint == "" {
+			realityConfig.Fingerprint = "chrome"
+		}
+
+		if err = validateFingerprint(realityConfig.Fingerprint); err != nil {
+			errs = append(errs, err)
+		}
+
+		settings.SecurityType = "reality"
+		settings.SecuritySettings = realityConfig
+	case config.VLESSSecurityTLS:
+		if cfg.Fingerprint != "" {
+			if err := validateFingerprint(cfg.Fingerprint); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		settings.SecurityType = "tls"
+		settings.SecuritySettings = &tls.Config{
+			ServerName:   cfg.ServerName,
+			NextProtocol: cfg.ALPN,
+			Fingerprint:  cfg.Fingerprint,
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported vless security: %s", cfg.Security))
+	}
+
+	switch cfg.Transport {
+	case config.VLESSTransportTCP:
+		settings.ProtocolName = "tcp"
+		settings.ProtocolSettings = &tcp.Config{}
+	case config.VLESSTransportWebSocket:
+		// the websocket dialer of xray-core only knows tls, with reality it would send plain text
+		if cfg.Security == config.VLESSSecurityReality {
+			errs = append(errs, fmt.Errorf("transport %s can not be used with %s security", cfg.Transport, cfg.Security))
+		}
+
+		settings.ProtocolName = "websocket"
+		settings.ProtocolSettings = &websocket.Config{
+			Host: cfg.Host,
+			Path: cfg.Path,
+		}
+	case config.VLESSTransportGRPC:
+		settings.ProtocolName = "grpc"
+		settings.ProtocolSettings = &grpc.Config{
+			Authority:   cfg.Host,
+			ServiceName: cfg.Path,
+			MultiMode:   cfg.Mode == "multi",
+		}
+	case config.VLESSTransportXHTTP:
+		settings.ProtocolName = "splithttp"
+		settings.ProtocolSettings = &splithttp.Config{
+			Host: cfg.Host,
+			Path: cfg.Path,
+			Mode: cfg.Mode,
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported vless transport: %s", cfg.Transport))
+	}
+
+	return settings, errors.Join(errs...)
+}
+
+var useOutboundOnce sync.Once
+
+// useOutbound makes the xray-core transports open their sockets with the outbound options,
+// the system dialer is global, so only the first outbound is installed
+func useOutbound(outbound *dialer.Outbound) {
+	useOutboundOnce.Do(func() {
+		internet.UseAlternativeSystemDialer(&systemDialer{outbound: outbound})
+	})
+}
+
+type systemDialer struct {
+	outbound *dialer.Outbound
+}
+
+func (d *systemDialer) Dial(ctx context.Context, _ xnet.Address, dest xnet.Destination, _ *internet.SocketConfig) (net.Conn, error) {
+	conn, err := d.outbound.DialContext(ctx, dest.Network.SystemString(), dest.NetAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	// quic based transports expect a packet conn, as returned by the default system dialer
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		return &internet.PacketConnWrapper{
+			PacketConn: connectedPacketConn{udpConn},
+			Dest:       udpConn.RemoteAddr(),
+		}, nil
+	}
+
+	return conn, nil
+}
+
+func (d *systemDialer) DestIpAddress() net.IP {
+	return nil
+}
+
+// connectedPacketConn sends every packet to the peer the socket is connected to,
+// it hides the udp conn so quic-go does not use the msg apis that need an unconnected socket
+type connectedPacketConn struct {
+	conn *net.UDPConn
+}
+
+func (c connectedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.conn.ReadFrom(b)
+}
+
+func (c connectedPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.conn.Write(b)
+}
+
+func (c connectedPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c connectedPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c connectedPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c connectedPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c connectedPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/xtls/xray-core/transport/internet/grpc"
+	"github.com/xtls/xray-core/transport/internet/reality"
+	"github.com/xtls/xray-core/transport/internet/splithttp"
+	"github.com/xtls/xray-core/transport/internet/tls"
+	"github.com/xtls/xray-core/transport/internet/websocket"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// testPublicKey is a base64 encoded 32 byte reality public key
+const testPublicKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+func realityConfig(transport config.VLESSTransport) config.VLESSRealityConfig {
+	return config.VLESSRealityConfig{
+		ShortID:    "ab12",
+		PublicKey:  testPublicKey,
+		ServerName: "example.com",
+		Security:   config.VLESSSecurityReality,
+		Transport:  transport,
+	}
+}
+
+func TestStreamSettings(t *testing.T) {
+	settings, err := streamSettings(realityConfig(config.VLESSTransportTCP))
+	if err != nil {
+		t.Fatalf("streamSettings() error: %v", err)
+	}
+
+	if settings.SecurityType != "reality" || settings.ProtocolName != "tcp" {
+		t.Errorf("got security %s over %s, want: reality over tcp", settings.SecurityType, settings.ProtocolName)
+	}
+
+	realitySettings := settings.SecuritySettings.(*reality.Config)
+	if realitySettings.Fingerprint != "chrome" {
+		t.Errorf("got fingerprint %s, want: chrome", realitySettings.Fingerprint)
+	}
+	if len(realitySettings.ShortId) != 2 || len(realitySettings.PublicKey) != 32 || realitySettings.ServerName != "example.com" {
+		t.Errorf("got short id %x, public key of %d bytes and server name %s",
+			realitySettings.ShortId, len(realitySettings.PublicKey), realitySettings.ServerName)
+	}
+
+	settings, err = streamSettings(config.VLESSRealityConfig{
+		ServerName: "cdn.example.com",
+		Security:   config.VLESSSecurityTLS,
+		Transport:  config.VLESSTransportGRPC,
+		ALPN:       []string{"h2"},
+		Host:       "grpc.example.com",
+		Path:       "tunnel",
+		Mode:       "multi",
+	})
+	if err != nil {
+		t.Fatalf("streamSettings() error: %v", err)
+	}
+	if settings.SecurityType != "tls" || settings.ProtocolName != "grpc" {
+		t.Errorf("got security %s over %s, want: tls over grpc", settings.SecurityType, settings.ProtocolName)
+	}
+
+	tlsSettings := settings.SecuritySettings.(*tls.Config)
+	if tlsSettings.ServerName != "cdn.example.com" || len(tlsSettings.NextProtocol) != 1 {
+		t.Errorf("got server name %s and alpn %v", tlsSettings.ServerName, tlsSettings.NextProtocol)
+	}
+
+	grpcSettings := settings.ProtocolSettings.(*grpc.Config)
+	if grpcSettings.Authority != "grpc.example.com" || grpcSettings.ServiceName != "tunnel" || !grpcSettings.MultiMode {
+		t.Errorf("got grpc settings %+v", grpcSettings)
+	}
+}
+
+func TestStreamSettingsTransports(t *testing.T) {
+	cfg := realityConfig(config.VLESSTransportXHTTP)
+	cfg.Host, cfg.Path, cfg.Mode = "xhttp.example.com", "/up", "packet-up"
+
+	settings, err := streamSettings(cfg)
+	if err != nil {
+		t.Fatalf("streamSettings() error: %v", err)
+	}
+
+	xhttpSettings := settings.ProtocolSettings.(*splithttp.Config)
+	if settings.ProtocolName != "splithttp" || xhttpSettings.Host != cfg.Host || xhttpSettings.Path != cfg.Path || xhttpSettings.Mode != cfg.Mode {
+		t.Errorf("got %s settings %+v", settings.ProtocolName, xhttpSettings)
+	}
+
+	cfg = config.VLESSRealityConfig{
+		ServerName: "cdn.example.com",
+		Security:   config.VLESSSecurityTLS,
+		Transport:  config.VLESSTransportWebSocket,
+		Host:       "ws.example.com",
+		Path:       "/vless",
+	}
+
+	if settings, err = streamSettings(cfg); err != nil {
+		t.Fatalf("streamSettings() error: %v", err)
+	}
+
+	wsSettings := settings.ProtocolSettings.(*websocket.Config)
+	if settings.ProtocolName != "websocket" || wsSettings.Host != cfg.Host || wsSettings.Path != cfg.Path {
+		t.Errorf("got %s settings %+v", settings.ProtocolName, wsSettings)
+	}
+}
+
+func TestStreamSettingsInvalid(t *testing.T) {
+	for name, modify := range map[string]func(*config.VLESSRealityConfig){
+		"reality over ws":     func(cfg *config.VLESSRealityConfig) { cfg.Transport = config.VLESSTransportWebSocket },
+		"long short id":       func(cfg *config.VLESSRealityConfig) { cfg.ShortID = "000102030405060708" },
+		"invalid short id":    func(cfg *config.VLESSRealityConfig) { cfg.ShortID = "xyz" },
+		"short public key":    func(cfg *config.VLESSRealityConfig) { cfg.PublicKey = "AAAA" },
+		"missing server name": func(cfg *config.VLESSRealityConfig) { cfg.ServerName = "" },
+		"unknown fingerprint": func(cfg *config.VLESSRealityConfig) { cfg.Fingerprint = "netscape" },
+		"unknown security":    func(cfg *config.VLESSRealityConfig) { cfg.Security = "none" },
+		"unknown transport":   func(cfg *config.VLESSRealityConfig) { cfg.Transport = "kcp" },
+	} {
+		cfg := realityConfig(config.VLESSTransportTCP)
+		modify(&cfg)
+
+		if _, err := streamSettings(cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
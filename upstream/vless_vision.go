@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"unsafe"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/transport/internet/reality"
+)
+
+// vision implements the xtls-rprx-vision flow: the inner tls handshake is padded
+// to hide its length signature, and once the inner tls 1.3 session is established
+// both directions switch to the raw tcp connection underneath reality
+type vision struct {
+	reader buf.Reader
+	writer buf.Writer
+
+	pending buf.MultiBuffer
+	readErr error
+}
+
+// newVision writes the vless request header followed by a padding block,
+// so the header never leaves in a packet of its own
+func newVision(conn net.Conn, userID, header []byte) (*vision, error) {
+	realityConn, ok := conn.(*reality.UConn)
+	if !ok {
+		return nil, errors.New("vision flow requires a reality connection")
+	}
+
+	input, rawInput := tlsInput(realityConn.Conn)
+
+	ctx := context.Background()
+	state := proxy.NewTrafficState(userID)
+
+	bufferedWriter := buf.NewBufferedWriter(buf.NewWriter(conn))
+	if _, err := bufferedWriter.Write(header); err != nil {
+		return nil, err
+	}
+
+	writer := proxy.NewVisionWriter(bufferedWriter, state, true, ctx, conn, nil, nil)
+
+	// an empty buffer is replaced with long padding
+	if err := writer.WriteMultiBuffer(make(buf.MultiBuffer, 1)); err != nil {
+		return nil, err
+	}
+
+	// flush, writes are unbuffered from now on
+	if err := bufferedWriter.SetBuffered(false); err != nil {
+		return nil, err
+	}
+
+	return &vision{
+		reader: proxy.NewVisionReader(buf.NewReader(conn), state, false, ctx, conn, input, rawInput, nil),
+		writer: writer,
+	}, nil
+}
+
+// tlsInput returns the read buffers of a tls connection, vision drains them when it switches
+// to direct copy, they are unexported so they are located the way xray-core does it
+func tlsInput(conn any) (*bytes.Reader, *bytes.Buffer) {
+	t := reflect.TypeOf(conn).Elem()
+	p := reflect.ValueOf(conn).UnsafePointer()
+
+	inputField, _ := t.FieldByName("input")
+	rawInputField, _ := t.FieldByName("rawInput")
+
+	return (*bytes.Reader)(unsafe.Add(p, inputField.Offset)), (*bytes.Buffer)(unsafe.Add(p, rawInputField.Offset))
+}
+
+func (v *vision) Read(p []byte) (int, error) {
+	for v.pending.IsEmpty() {
+		if v.readErr != nil {
+			return 0, v.readErr
+		}
+
+		mb, err := v.reader.ReadMultiBuffer()
+		v.pending = append(v.pending, mb...)
+		v.readErr = err
+	}
+
+	var n int
+	v.pending, n = buf.SplitBytes(v.pending, p)
+
+	return n, nil
+}
+
+func (v *vision) Write(p []byte) (int, error) {
+	if err := v.writer.WriteMultiBuffer(buf.MergeBytes(nil, p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,236 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	goreality "github.com/xtls/reality"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vless/encoding"
+	"github.com/xtls/xray-core/transport/internet/reality"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// visionRequest is what the vision server decoded from the vless request
+type visionRequest struct {
+	target string
+	flow   string
+	// directCopy is set when the uplink switched to the raw connection
+	directCopy bool
+}
+
+// visionServer accepts a reality connection and relays a vision flow to target the way
+// xray's vless inbound does, the decoded request is sent once the client closes the uplink
+func visionServer(conn net.Conn, realityConfig *goreality.Config, validator vless.Validator, target string, requests chan<- visionRequest) error {
+	defer conn.Close()
+
+	realityConn, err := reality.Server(conn, realityConfig)
+	if err != nil {
+		return err
+	}
+	serverConn := realityConn.(*reality.Conn)
+
+	userID, request, addons, _, err := encoding.DecodeRequestHeader(false, nil, serverConn, validator)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := net.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer targetConn.Close()
+
+	ctx := context.Background()
+	state := proxy.NewTrafficState(userID)
+	input, rawInput := tlsInput(serverConn.Conn)
+
+	reader := proxy.NewVisionReader(buf.NewReader(serverConn), state, true, ctx, serverConn, input, rawInput, nil)
+
+	bufferedWriter := buf.NewBufferedWriter(buf.NewWriter(serverConn))
+	if err = encoding.EncodeResponseHeader(bufferedWriter, request, &encoding.Addons{}); err != nil {
+		return err
+	}
+	if err = bufferedWriter.SetBuffered(false); err != nil {
+		return err
+	}
+	writer := proxy.NewVisionWriter(bufferedWriter, state, false, ctx, serverConn, nil, nil)
+
+	go func() { _ = buf.Copy(buf.NewReader(targetConn), writer) }()
+
+	err = buf.Copy(reader, buf.NewWriter(targetConn))
+
+	requests <- visionRequest{
+		target:     fmt.Sprintf("%s:%d", request.Address, request.Port),
+		flow:       addons.Flow,
+		directCopy: state.Inbound.UplinkReaderDirectCopy,
+	}
+
+	return err
+}
+
+func TestVLESSVision(t *testing.T) {
+	const serverName = "dest.test"
+
+	// the reality server borrows the handshake of a real tls 1.3 server
+	destCert, _ := testCertificate(t, serverName)
+	dest, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{destCert}, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	// the inner tls 1.3 connection is what vision unwraps
+	echoCert, echoPool := testCertificate(t, "echo.test")
+	echo, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{echoCert}, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortID := [8]byte{0xab, 0xcd}
+
+	id := uuid.New()
+	validator := new(vless.MemoryValidator)
+	if err = validator.Add(&protocol.MemoryUser{Account: &vless.MemoryAccount{ID: protocol.NewID(id), Flow: vless.XRV}}); err != nil {
+		t.Fatal(err)
+	}
+
+	realityConfig := &goreality.Config{
+		DialContext: new(net.Dialer).DialContext,
+		Type:        "tcp",
+		Dest:        dest.Addr().String(),
+		ServerNames: map[string]bool{serverName: true},
+		PrivateKey:  privateKey.Bytes(),
+		ShortIds:    map[[8]byte]bool{shortID: true},
+		// as xray configures its reality inbound
+		SessionTicketsDisabled: true,
+	}
+
+	// the server waits for a probe of the records dest sends after its handshake, the test dest sends none
+	for alpn := range 3 {
+		goreality.GlobalPostHandshakeRecordsLens.Store(fmt.Sprintf("%s %s %d", realityConfig.Dest, serverName, alpn), []int{})
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	requests := make(chan visionRequest, 1)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = visionServer(conn, realityConfig, validator, echo.Addr().String(), requests) }()
+		}
+	}()
+
+	v := NewVlessReality(config.VLESSRealityConfig{
+		Address:    ln.Addr().String(),
+		UUID:       id.String(),
+		ShortID:    hex.EncodeToString(shortID[:2]),
+		PublicKey:  base64.RawURLEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+		ServerName: serverName,
+		Flow:       vless.XRV,
+		Security:   config.VLESSSecurityReality,
+		Transport:  config.VLESSTransportTCP,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err = v.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	conn, err := v.Connect("example.com", 443, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	inner := tls.Client(conn, &tls.Config{ServerName: "echo.test", RootCAs: echoPool, MinVersion: tls.VersionTLS13})
+	if err = inner.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a short message is padded, a large one spans many records after the switch to direct copy
+	for _, message := range [][]byte{[]byte("ping"), bytes.Repeat([]byte("vision"), 64<<10)} {
+		if _, err = inner.Write(message); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+
+		reply := make([]byte, len(message))
+		if _, err = io.ReadFull(inner, reply); err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if !bytes.Equal(reply, message) {
+			t.Errorf("got %d bytes of echo, not matching the %d bytes written", len(reply), len(message))
+		}
+	}
+
+	if err = inner.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite() error: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case request := <-requests:
+		if request.target != "example.com:443" {
+			t.Errorf("got target %s, want: example.com:443", request.target)
+		}
+		if request.flow != vless.XRV {
+			t.Errorf("got flow %q, want: %s", request.flow, vless.XRV)
+		}
+		if !request.directCopy {
+			t.Error("uplink did not switch to direct copy")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not finish the request")
+	}
+}
@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"net"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/xtls/xray-core/common/buf"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/proxy/vmess"
+	"github.com/xtls/xray-core/proxy/vmess/encoding"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+var vmessSecurityTypes = map[config.VMessSecurity]protocol.SecurityType{
+	config.VMessSecurityAuto:             protocol.SecurityType_AUTO,
+	config.VMessSecurityAES128GCM:        protocol.SecurityType_AES128_GCM,
+	config.VMessSecurityChacha20Poly1305: protocol.SecurityType_CHACHA20_POLY1305,
+	config.VMessSecurityNone:             protocol.SecurityType_NONE,
+}
+
+// vmessHeaderDelay is how long the request header waits for the first payload, as long as xray-core waits
+const vmessHeaderDelay = 100 * time.Millisecond
+
+type VMess struct {
+	config   config.VMessConfig
+	outbound *dialer.Outbound
+
+	user         *protocol.MemoryUser
+	security     protocol.SecurityType
+	behaviorSeed int64
+	tlsConfig    *tls.Config
+	fingerprint  *utls.ClientHelloID
+}
+
+func NewVMess(config config.VMessConfig, outbound *dialer.Outbound) *VMess {
+	return &VMess{
+		config:   config,
+		outbound: outbound,
+	}
+}
+
+func (v *VMess) Init() error {
+	var errs []error
+
+	if err := validateAddress(v.config.Address); err != nil {
+		errs = append(errs, err)
+	}
+
+	uid, err := parseUserID(v.config.UUID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	security, ok := vmessSecurityTypes[v.config.Security]
+	if !ok {
+		errs = append(errs, fmt.Errorf("unsupported vmess security: %q", v.config.Security))
+	}
+
+	if !v.config.TLS && (v.config.ServerName != "" || v.config.Fingerprint != "" || len(v.config.ALPN) > 0) {
+		errs = append(errs, errors.New("server name, fingerprint and alpn require tls"))
+	}
+
+	if v.config.Fingerprint != "" {
+		if err := validateFingerprint(v.config.Fingerprint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	settings := &protocol.SecurityConfig{Type: security}
+
+	account, err := (&vmess.Account{
+		Id:               uid.String(),
+		SecuritySettings: settings,
+	}).AsAccount()
+	if err != nil {
+		return fmt.Errorf("failed to create vmess account: %w", err)
+	}
+
+	v.user = &protocol.MemoryUser{Account: account}
+	// auto picks aes-128-gcm when the cpu supports it, chacha20-poly1305 otherwise
+	v.security = settings.GetSecurityType()
+
+	// the drainer applied to invalid responses is seeded per user, same as xray-core
+	mac := hmac.New(sha256.New, []byte("VMessBF"))
+	mac.Write(uid.Bytes())
+	v.behaviorSeed = int64(crc64.Checksum(mac.Sum(nil), crc64.MakeTable(crc64.ISO)))
+
+	if v.config.TLS {
+		serverName := v.config.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(v.config.Address)
+		}
+
+		v.tlsConfig = &tls.Config{
+			ServerName: serverName,
+			NextProtos: v.config.ALPN,
+		}
+
+		if v.config.Fingerprint != "" {
+			v.fingerprint = xtls.GetFingerprint(v.config.Fingerprint)
+		}
+	}
+
+	return nil
+}
+
+func (v *VMess) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	d := v.outbound.Dialer()
+	d.Timeout = timeout
+
+	conn, err := d.Dial("tcp", v.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial vmess server: %w", err)
+	}
+
+	if v.tlsConfig != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		tlsConn, err := tlsHandshake(ctx, conn, v.tlsConfig, v.fingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	vmessConn, err := v.newConn(conn, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return vmessConn, nil
+}
+
+func (v *VMess) newConn(conn net.Conn, host string, port uint16) (*VMessConn, error) {
+	request := &protocol.RequestHeader{
+		Version:  encoding.Version,
+		User:     v.user,
+		Command:  protocol.RequestCommandTCP,
+		Address:  xnet.ParseAddress(host),
+		Port:     xnet.Port(port),
+		Option:   protocol.RequestOptionChunkStream | protocol.RequestOptionChunkMasking,
+		Security: v.security,
+	}
+
+	if request.Security != protocol.SecurityType_NONE {
+		request.Option.Set(protocol.RequestOptionGlobalPadding)
+	}
+
+	session := encoding.NewClientSession(context.Background(), v.behaviorSeed)
+
+	// the header is buffered and sent together with the first payload
+	writer := buf.NewBufferedWriter(buf.NewWriter(conn))
+
+	if err := session.EncodeRequestHeader(request, writer); err != nil {
+		return nil, fmt.Errorf("failed to encode vmess request: %w", err)
+	}
+
+	bodyWriter, err := session.EncodeRequestBody(request, writer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vmess request body: %w", err)
+	}
+
+	vmessConn := &VMessConn{
+		Conn:       conn,
+		session:    session,
+		request:    request,
+		writer:     writer,
+		bodyWriter: bodyWriter,
+	}
+
+	// a client waiting for the server to speak first never writes, the header goes out alone then
+	vmessConn.flushTimer = time.AfterFunc(vmessHeaderDelay, func() {
+		vmessConn.mu.Lock()
+		defer vmessConn.mu.Unlock()
+
+		_ = vmessConn.flushHeader()
+	})
+
+	return vmessConn, nil
+}
+
+func (v *VMess) Close() error {
+	return nil
+}
+
+type VMessConn struct {
+	net.Conn
+
+	session *encoding.ClientSession
+	request *protocol.RequestHeader
+
+	mu         sync.Mutex
+	writer     *buf.BufferedWriter
+	bodyWriter buf.Writer
+	flush      sync.Once
+	flushErr   error
+	flushTimer *time.Timer
+
+	response   sync.Once
+	bodyReader *buf.BufferedReader
+	readErr    error
+}
+
+func (c *VMessConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.bodyWriter.WriteMultiBuffer(buf.MergeBytes(nil, b)); err != nil {
+		return 0, err
+	}
+
+	if err := c.flushHeader(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// flushHeader stops buffering so the request header goes out on the wire
+func (c *VMessConn) flushHeader() error {
+	c.flush.Do(func() {
+		c.flushErr = c.writer.SetBuffered(false)
+	})
+
+	return c.flushErr
+}
+
+func (c *VMessConn) Read(b []byte) (int, error) {
+	// the header is flushed by the first write or the timer, the server responds after it got it
+	c.response.Do(func() {
+		reader := &buf.BufferedReader{Reader: buf.NewReader(c.Conn)}
+
+		if _, c.readErr = c.session.DecodeResponseHeader(reader); c.readErr != nil {
+			c.readErr = fmt.Errorf("failed to decode vmess response: %w", c.readErr)
+			return
+		}
+
+		bodyReader, err := c.session.DecodeResponseBody(c.request, reader)
+		if err != nil {
+			c.readErr = fmt.Errorf("failed to decode vmess response body: %w", err)
+			return
+		}
+
+		c.bodyReader = &buf.BufferedReader{Reader: bodyReader}
+	})
+
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	return c.bodyReader.Read(b)
+}
+
+func (c *VMessConn) Close() error {
+	c.flushTimer.Stop()
+
+	c.mu.Lock()
+	// an empty chunk tells the server the stream has ended
+	_ = c.bodyWriter.WriteMultiBuffer(buf.MultiBuffer{})
+	_ = c.flushHeader()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
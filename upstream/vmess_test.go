@@ -0,0 +1,342 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy/vmess"
+	"github.com/xtls/xray-core/proxy/vmess/encoding"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// vmessServer decodes the request with the xray-core server session, sends the banner and echoes the payload
+func vmessServer(conn net.Conn, validator *vmess.TimedUserValidator, history *encoding.SessionHistory, banner string, targets chan<- string) error {
+	defer conn.Close()
+
+	session := encoding.NewServerSession(validator, history)
+	reader := &buf.BufferedReader{Reader: buf.NewReader(conn)}
+
+	request, err := session.DecodeRequestHeader(reader, false)
+	if err != nil {
+		return err
+	}
+	targets <- request.Destination().NetAddr()
+
+	bodyReader, err := session.DecodeRequestBody(request, reader)
+	if err != nil {
+		return err
+	}
+
+	writer := buf.NewBufferedWriter(buf.NewWriter(conn))
+	session.EncodeResponseHeader(&protocol.ResponseHeader{}, writer)
+
+	bodyWriter, err := session.EncodeResponseBody(request, writer)
+	if err != nil {
+		return err
+	}
+
+	if err = writer.SetBuffered(false); err != nil {
+		return err
+	}
+
+	if banner != "" {
+		if err = bodyWriter.WriteMultiBuffer(buf.MergeBytes(nil, []byte(banner))); err != nil {
+			return err
+		}
+	}
+
+	return buf.Copy(bodyReader, bodyWriter)
+}
+
+// vmessUser returns a new uuid and a validator that knows it
+func vmessUser(t *testing.T) (uuid.UUID, *vmess.TimedUserValidator) {
+	t.Helper()
+
+	id := uuid.New()
+
+	account, err := (&vmess.Account{Id: id.String()}).AsAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validator := vmess.NewTimedUserValidator()
+	if err = validator.Add(&protocol.MemoryUser{Account: account}); err != nil {
+		t.Fatal(err)
+	}
+
+	return id, validator
+}
+
+func TestVMess(t *testing.T) {
+	id, validator := vmessUser(t)
+
+	history := encoding.NewSessionHistory()
+	defer history.Close()
+
+	cert, pool := testCertificate(t, "vmess.test")
+
+	for _, tc := range []struct {
+		name        string
+		security    config.VMessSecurity
+		tls         bool
+		fingerprint string
+	}{
+		{name: "auto", security: config.VMessSecurityAuto},
+		{name: "aes-128-gcm", security: config.VMessSecurityAES128GCM},
+		{name: "chacha20-poly1305", security: config.VMessSecurityChacha20Poly1305},
+		{name: "none", security: config.VMessSecurityNone},
+		{name: "tls", security: config.VMessSecurityAuto, tls: true},
+		{name: "utls", security: config.VMessSecurityAuto, tls: true, fingerprint: "chrome"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.tls {
+				ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+			}
+			defer ln.Close()
+
+			targets := make(chan string, 1)
+
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() { _ = vmessServer(conn, validator, history, "", targets) }()
+				}
+			}()
+
+			cfg := config.VMessConfig{
+				Address:  ln.Addr().String(),
+				UUID:     id.String(),
+				Security: tc.security,
+				TLS:      tc.tls,
+			}
+			if tc.tls {
+				cfg.ServerName = "vmess.test"
+				cfg.Fingerprint = tc.fingerprint
+			}
+
+			v := NewVMess(cfg, dialer.NewOutbound(config.OutboundConfig{}))
+
+			if err := v.Init(); err != nil {
+				t.Fatalf("Init() error: %v", err)
+			}
+			if v.tlsConfig != nil {
+				v.tlsConfig.RootCAs = pool
+			}
+
+			conn, err := v.Connect("example.com", 443, time.Second)
+			if err != nil {
+				t.Fatalf("Connect() error: %v", err)
+			}
+			defer conn.Close()
+
+			// like the handler, the response is read before anything was written
+			replies := make(chan []byte, 1)
+			go func() {
+				reply := make([]byte, 4)
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					t.Errorf("Read() error: %v", err)
+				}
+				replies <- reply
+			}()
+
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+
+			if reply := <-replies; string(reply) != "ping" {
+				t.Errorf("got %q, want: %q", reply, "ping")
+			}
+
+			if got := <-targets; got != "example.com:443" {
+				t.Errorf("got target %s, want: example.com:443", got)
+			}
+		})
+	}
+}
+
+// writeCounter counts the writes of a connection that cannot be read from
+type writeCounter struct {
+	net.Conn
+
+	writes atomic.Int32
+}
+
+func (c *writeCounter) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return len(b), nil
+}
+
+func (c *writeCounter) Close() error { return nil }
+
+// TestVMessHeaderCoalescing reads before the first write, the header still goes out with the payload
+func TestVMessHeaderCoalescing(t *testing.T) {
+	id, _ := vmessUser(t)
+
+	v := NewVMess(config.VMessConfig{
+		Address:  "203.0.113.1:443",
+		UUID:     id.String(),
+		Security: config.VMessSecurityAuto,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err := v.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	counter := new(writeCounter)
+
+	conn, err := v.newConn(counter, "example.com", 443)
+	if err != nil {
+		t.Fatalf("newConn() error: %v", err)
+	}
+	defer conn.Close()
+
+	_, _ = conn.Read(make([]byte, 4))
+	if n := counter.writes.Load(); n != 0 {
+		t.Errorf("got %d writes before the payload, want: 0", n)
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if n := counter.writes.Load(); n != 1 {
+		t.Errorf("got %d writes, want the header and the payload in 1", n)
+	}
+}
+
+// TestVMessServerFirst reads a banner without writing, the header goes out on its own after a delay
+func TestVMessServerFirst(t *testing.T) {
+	id, validator := vmessUser(t)
+
+	history := encoding.NewSessionHistory()
+	defer history.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	targets := make(chan string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = vmessServer(conn, validator, history, "220 ready", targets)
+	}()
+
+	v := NewVMess(config.VMessConfig{
+		Address:  ln.Addr().String(),
+		UUID:     id.String(),
+		Security: config.VMessSecurityAuto,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err = v.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	conn, err := v.Connect("example.com", 25, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	banner := make([]byte, 9)
+	if _, err = io.ReadFull(conn, banner); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(banner) != "220 ready" {
+		t.Errorf("got %q, want: %q", banner, "220 ready")
+	}
+
+	if target := <-targets; target != "example.com:25" {
+		t.Errorf("got target %s, want: example.com:25", target)
+	}
+}
+
+func TestVMessWrongUUID(t *testing.T) {
+	_, validator := vmessUser(t)
+	wrong := uuid.New()
+
+	history := encoding.NewSessionHistory()
+	defer history.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	targets := make(chan string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = vmessServer(conn, validator, history, "", targets)
+	}()
+
+	v := NewVMess(config.VMessConfig{
+		Address:  ln.Addr().String(),
+		UUID:     wrong.String(),
+		Security: config.VMessSecurityAuto,
+	}, dialer.NewOutbound(config.OutboundConfig{}))
+
+	if err = v.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+
+	conn, err := v.Connect("example.com", 443, time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 4)); err == nil {
+		t.Error("expected the server to reject the uuid")
+	}
+	if len(targets) != 0 {
+		t.Error("the server decoded a request with the wrong uuid")
+	}
+}
+
+func TestVMessInit(t *testing.T) {
+	id := uuid.New()
+
+	for _, cfg := range []config.VMessConfig{
+		{Address: "203.0.113.1:443", UUID: id.String(), Security: "aes-256-cfb"},
+		{Address: "203.0.113.1:443", UUID: id.String(), Security: config.VMessSecurityAuto, ServerName: "example.com"},
+		{Address: "203.0.113.1", UUID: id.String(), Security: config.VMessSecurityAuto},
+	} {
+		if err := NewVMess(cfg, dialer.NewOutbound(config.OutboundConfig{})).Init(); err == nil {
+			t.Errorf("%+v: expected error", cfg)
+		}
+	}
+}
@@ -2,124 +2,609 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/netip"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"golang.org/x/crypto/curve25519"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 
 	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
 )
 
 type Wireguard struct {
-	config config.WireguardConfig
+	config   config.WireguardConfig
+	outbound *dialer.Outbound
 
 	tnet *netstack.Net
 	dev  *device.Device
+
+	// address families with a tunnel address, and the ranges routed to a peer
+	hasV4, hasV6 bool
+	routes       []wireguardRoute
+	peers        []*wireguardPeerHealth
+	amnezia      *amneziaBind
+	stream       *streamBind
+
+	// dns resolves destinations inside the tunnel after the host overrides, resolver resolves endpoints outside of it
+	dns      *dialer.Resolver
+	dnsAddrs []netip.Addr
+	hosts    *dialer.Hosts
+	resolver *dialer.Resolver
+	// policy checks the resolved addresses, the names were only checked by their suffix
+	policy *dialer.Policy
+	done   chan struct{}
+}
+
+type wireguardRoute struct {
+	prefix netip.Prefix
+	peer   *wireguardPeerHealth
+}
+
+func NewWireguard(config config.WireguardConfig, outbound *dialer.Outbound, resolver *dialer.Resolver, hosts *dialer.Hosts, policy *dialer.Policy) *Wireguard {
+	return &Wireguard{
+		config:   config,
+		outbound: outbound,
+		resolver: resolver,
+		hosts:    hosts,
+		policy:   policy,
+	}
 }
 
-func NewWireguard(config config.WireguardConfig) *Wireguard {
-	return &Wireguard{config: config}
+// wireguardDevice is the validated configuration the device is created from,
+// with the state Init takes over once the device is up
+type wireguardDevice struct {
+	settings      wireguardSettings
+	privateKeyHex string
+	tunnelAddrs   []netip.Addr
+	ipc           string
+
+	hasV4, hasV6 bool
+	routes       []wireguardRoute
+	peers        []*wireguardPeerHealth
+	dns          *dialer.Resolver
+	dnsAddrs     []netip.Addr
 }
 
 func (w *Wireguard) Init() error {
-	if w.config.MTU == 0 {
-		w.config.MTU = 1420
+	wgDevice, err := w.prepare()
+	if err != nil {
+		return err
 	}
-	if w.config.DNS == "" {
-		w.config.DNS = "1.1.1.1"
+
+	// the netstack gets no dns servers, names are only resolved by w.dns
+	tunDev, tnet, err := netstack.CreateNetTUN(wgDevice.tunnelAddrs, nil, wgDevice.settings.MTU)
+	if err != nil {
+		return fmt.Errorf("create tun: %w", err)
 	}
-	if w.config.KeepaliveInterval == 0 {
-		w.config.KeepaliveInterval = 25
+
+	bind := conn.NewDefaultBind()
+
+	if w.config.Transport != config.WireguardTransportUDP {
+		streamDialer := &streamDialer{
+			transport: w.config.Transport,
+			outbound:  w.outbound,
+			path:      w.config.Path,
+		}
+
+		if w.config.TLS {
+			streamDialer.tlsConfig = &tls.Config{ServerName: w.config.ServerName}
+			if w.config.Transport == config.WireguardTransportWebSocket {
+				streamDialer.tlsConfig.NextProtos = []string{"http/1.1"}
+			}
+		}
+
+		if w.config.Fingerprint != "" {
+			streamDialer.fingerprint = xtls.GetFingerprint(w.config.Fingerprint)
+		}
+
+		w.stream = newStreamBind(streamDialer)
+		bind = w.stream
 	}
 
-	privateKeyHex, err := w.keyToHex(w.config.PrivateKey)
-	if err != nil {
-		return fmt.Errorf("private key: %w", err)
+	if wgDevice.settings.Amnezia.enabled() {
+		if bind, err = w.amneziaBind(bind, wgDevice.settings.Amnezia, wgDevice.privateKeyHex); err != nil {
+			_ = tunDev.Close()
+			return err
+		}
+	}
+
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	dev := device.NewDevice(tunDev, bind, logger)
+
+	if err = dev.IpcSet(wgDevice.ipc); err != nil {
+		dev.Close()
+		return fmt.Errorf("device IpcSet: %w", err)
+	}
+
+	w.dev = dev
+	w.tnet = tnet
+	w.hasV4, w.hasV6 = wgDevice.hasV4, wgDevice.hasV6
+	w.routes = wgDevice.routes
+	w.peers = wgDevice.peers
+	w.dns = wgDevice.dns
+	w.dnsAddrs = wgDevice.dnsAddrs
+
+	// the device only takes ip endpoints, a failed lookup is retried by the health check
+	for _, peer := range w.peers {
+		if err = w.updateEndpoint(peer, false); err != nil {
+			slog.Warn("failed to resolve wireguard endpoint", slog.String("endpoint", peer.endpoint), slog.Any("error", err))
+		}
+	}
+
+	if err = dev.Up(); err != nil {
+		dev.Close()
+		return fmt.Errorf("device up: %w", err)
+	}
+
+	if w.config.HealthCheckInterval > 0 {
+		w.done = make(chan struct{})
+		go w.monitor(w.config.HealthCheckInterval)
 	}
 
-	publicKeyHex, err := w.keyToHex(w.config.PublicKey)
+	return nil
+}
+
+// Validate checks the configuration without creating the device
+func (w *Wireguard) Validate() error {
+	_, err := w.prepare()
+
+	return err
+}
+
+// prepare validates the settings and builds the device configuration, the routes, peers and
+// the tunnel resolver, nothing is started and w is not changed
+func (w *Wireguard) prepare() (wireguardDevice, error) {
+	settings := wireguardSettingsFromEnv(w.config)
+
+	if w.config.Config != "" {
+		data, err := loadWireguardConf(w.config.Config)
+		if err != nil {
+			return wireguardDevice{}, fmt.Errorf("failed to load wireguard config: %w", err)
+		}
+
+		var warnings []string
+		if settings, warnings, err = parseWireguardConf(data); err != nil {
+			return wireguardDevice{}, fmt.Errorf("invalid wireguard config: %w", err)
+		}
+
+		for _, warning := range warnings {
+			slog.Warn("wireguard config", slog.String("warning", warning))
+		}
+
+		// a config file only lists plain dns servers, the variable can pick an encrypted one
+		if len(w.config.DNS) > 0 {
+			settings.DNS = w.config.DNS
+		}
+	}
+
+	if settings.MTU == 0 {
+		settings.MTU = 1420
+	}
+	if len(settings.DNS) == 0 {
+		settings.DNS = []string{"1.1.1.1"}
+	}
+
+	var errs []error
+
+	privateKeyHex, err := w.keyToHex(settings.PrivateKey)
 	if err != nil {
-		return fmt.Errorf("public key: %w", err)
+		errs = append(errs, fmt.Errorf("private key: %w", err))
+	}
+
+	if err = settings.Amnezia.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("amneziawg: %w", err))
+	}
+
+	switch w.config.Transport {
+	case config.WireguardTransportUDP:
+		if w.config.TLS {
+			errs = append(errs, errors.New("tls requires the tcp or ws transport"))
+		}
+	case config.WireguardTransportTCP, config.WireguardTransportWebSocket:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported wireguard transport: %q", w.config.Transport))
+	}
+
+	if !w.config.TLS && (w.config.ServerName != "" || w.config.Fingerprint != "") {
+		errs = append(errs, errors.New("server name and fingerprint require tls"))
+	}
+
+	if w.config.Fingerprint != "" {
+		if err = validateFingerprint(w.config.Fingerprint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(settings.Addresses) == 0 {
+		errs = append(errs, errors.New("no tunnel ip"))
+	}
+
+	var wgDevice wireguardDevice
+
+	for _, address := range settings.Addresses {
+		// wg-quick addresses carry a prefix length, which has no meaning for the netstack
+		addr, err := netip.ParseAddr(strings.Split(address, "/")[0])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tunnel ip %q: %w", address, err))
+			continue
+		}
+		wgDevice.tunnelAddrs = append(wgDevice.tunnelAddrs, addr)
+
+		wgDevice.hasV4 = wgDevice.hasV4 || addr.Is4()
+		wgDevice.hasV6 = wgDevice.hasV6 || addr.Is6()
+	}
+
+	var dnsServers []string
+
+	for _, server := range settings.DNS {
+		serverURL, err := wireguardDNSServer(server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dns %q: %w", server, err))
+			continue
+		}
+		dnsServers = append(dnsServers, serverURL)
+
+		u, _ := url.Parse(serverURL)
+		if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+			wgDevice.dnsAddrs = append(wgDevice.dnsAddrs, addr.Unmap())
+		}
+	}
+
+	dnsTimeout := w.config.DNSTimeout
+	if dnsTimeout == 0 {
+		dnsTimeout = 5 * time.Second
+	}
+
+	resolverConfig := config.ResolverConfig{
+		Servers:    dnsServers,
+		ServerName: w.config.DNSServerName,
+		Timeout:    dnsTimeout,
+	}
+	resolverConfig.Cache.Size = w.config.DNSCacheSize
+	resolverConfig.Cache.MinTTL = 10 * time.Second
+	resolverConfig.Cache.MaxTTL = time.Hour
+	resolverConfig.Cache.NegativeTTL = 30 * time.Second
+
+	wgDevice.dns = dialer.NewResolver(resolverConfig, w.dialTunnel)
+	if err = wgDevice.dns.Init(); err != nil {
+		errs = append(errs, err)
+	}
+
+	var ipc strings.Builder
+
+	fmt.Fprintf(&ipc, "private_key=%s\n", privateKeyHex)
+	if settings.ListenPort != 0 {
+		fmt.Fprintf(&ipc, "listen_port=%d\n", settings.ListenPort)
+	}
+	if settings.FwMark != 0 {
+		fmt.Fprintf(&ipc, "fwmark=%d\n", settings.FwMark)
+	} else if mark := w.outbound.Mark(); mark != 0 {
+		// the udp socket of the device gets the same mark as tcp dials
+		fmt.Fprintf(&ipc, "fwmark=%d\n", mark)
+	}
+
+	for i, peer := range settings.Peers {
+		peerIPC, health, prefixes, err := w.peerIPC(peer)
+		if err != nil {
+			if len(settings.Peers) > 1 {
+				err = fmt.Errorf("peer %d: %w", i+1, err)
+			}
+			errs = append(errs, err)
+		}
+		ipc.WriteString(peerIPC)
+
+		// the device routes by longest prefix, only an identical range would silently move to the last peer
+		for _, prefix := range prefixes {
+			for _, route := range wgDevice.routes {
+				if route.prefix.Masked() == prefix.Masked() {
+					owner := slices.Index(wgDevice.peers, route.peer)
+					errs = append(errs, fmt.Errorf("peer %d: allowed ip %s is already routed to peer %d", i+1, prefix, owner+1))
+				}
+			}
+		}
+
+		for _, prefix := range prefixes {
+			wgDevice.routes = append(wgDevice.routes, wireguardRoute{prefix: prefix, peer: health})
+		}
+		wgDevice.peers = append(wgDevice.peers, health)
 	}
 
-	tunnelAddr, err := netip.ParseAddr(w.config.TunnelIP)
+	if len(errs) > 0 {
+		return wireguardDevice{}, errors.Join(errs...)
+	}
+
+	wgDevice.settings = settings
+	wgDevice.privateKeyHex = privateKeyHex
+	wgDevice.ipc = ipc.String()
+
+	return wgDevice, nil
+}
+
+// amneziaBind wraps the bind in the AmneziaWG format, it needs our public key to restore incoming handshakes
+func (w *Wireguard) amneziaBind(bind conn.Bind, params wireguardAmnezia, privateKeyHex string) (conn.Bind, error) {
+	privateKey, err := hex.DecodeString(privateKeyHex)
 	if err != nil {
-		return fmt.Errorf("tunnel ip %q: %w", w.config.TunnelIP, err)
+		return nil, err
 	}
 
-	dnsAddr, err := netip.ParseAddr(w.config.DNS)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
 	if err != nil {
-		return fmt.Errorf("dns %q: %w", w.config.DNS, err)
+		return nil, fmt.Errorf("public key: %w", err)
 	}
 
-	tunDev, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{tunnelAddr},
-		[]netip.Addr{dnsAddr},
-		w.config.MTU,
-	)
+	w.amnezia = newAmneziaBind(bind, params, device.NoisePublicKey(publicKey))
+
+	return w.amnezia, nil
+}
+
+// peerIPC validates a peer and returns its uapi configuration, health and allowed ips,
+// the endpoint is set once it has been resolved
+func (w *Wireguard) peerIPC(peer wireguardPeer) (string, *wireguardPeerHealth, []netip.Prefix, error) {
+	var errs []error
+
+	publicKeyHex, err := w.keyToHex(peer.PublicKey)
 	if err != nil {
-		return fmt.Errorf("create tun: %w", err)
+		errs = append(errs, fmt.Errorf("public key: %w", err))
 	}
 
-	logger := device.NewLogger(device.LogLevelSilent, "")
-	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), logger)
+	var presharedKeyHex string
+	if peer.PresharedKey != "" {
+		if presharedKeyHex, err = w.keyToHex(peer.PresharedKey); err != nil {
+			errs = append(errs, fmt.Errorf("preshared key: %w", err))
+		}
+	}
+
+	if err = validateAddress(peer.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("endpoint: %w", err))
+	}
+
+	if len(peer.AllowedIPs) == 0 {
+		errs = append(errs, errors.New("no allowed ips"))
+	}
 
 	var ipc strings.Builder
+	var prefixes []netip.Prefix
 
-	fmt.Fprintf(&ipc, "private_key=%s\n", privateKeyHex)
 	fmt.Fprintf(&ipc, "public_key=%s\n", publicKeyHex)
-	fmt.Fprintf(&ipc, "endpoint=%s\n", w.config.Endpoint)
-	fmt.Fprintf(&ipc, "persistent_keepalive_interval=%d\n", w.config.KeepaliveInterval)
-	ipc.WriteString("allowed_ip=0.0.0.0/0\n")
-	ipc.WriteString("allowed_ip=::/0\n")
+	fmt.Fprintf(&ipc, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
 
-	if w.config.PresharedKey != "" {
-		presharedKeyHex, err := w.keyToHex(w.config.PresharedKey)
+	for _, allowedIP := range peer.AllowedIPs {
+		prefix, err := netip.ParsePrefix(allowedIP)
 		if err != nil {
-			dev.Close()
-			return fmt.Errorf("preshared key: %w", err)
+			errs = append(errs, fmt.Errorf("allowed ip %q: %w", allowedIP, err))
+			continue
 		}
+		prefixes = append(prefixes, prefix.Masked())
+		fmt.Fprintf(&ipc, "allowed_ip=%s\n", prefix.Masked())
+	}
+
+	if presharedKeyHex != "" {
 		fmt.Fprintf(&ipc, "preshared_key=%s\n", presharedKeyHex)
 	}
 
-	if err = dev.IpcSet(ipc.String()); err != nil {
-		dev.Close()
-		return fmt.Errorf("device IpcSet: %w", err)
+	health := &wireguardPeerHealth{
+		publicKey: publicKeyHex,
+		endpoint:  peer.Endpoint,
+		keepalive: peer.PersistentKeepalive,
 	}
+	health.healthy.Store(true)
 
-	if err = dev.Up(); err != nil {
-		dev.Close()
-		return fmt.Errorf("device up: %w", err)
+	return ipc.String(), health, prefixes, errors.Join(errs...)
+}
+
+// Connect resolves the host inside the tunnel and tries every address that can be routed,
+// the device only has addresses of the families it has a tunnel address for
+func (w *Wireguard) Connect(host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resolved, err := w.lookup(ctx, host)
+	if err != nil {
+		return nil, err
 	}
 
-	w.dev = dev
-	w.tnet = tnet
+	resolved, err = w.allowed(resolved, port)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	addrs, down := w.routable(resolved)
+	if len(addrs) == 0 && down {
+		return nil, fmt.Errorf("no recent wireguard handshake with the peer for %s", host)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of %s is routed through the tunnel: %v", host, resolved)
+	}
+
+	var errs []error
+
+	deadline, _ := ctx.Deadline()
+
+	for i, addr := range addrs {
+		address := netip.AddrPortFrom(addr, port)
+
+		// an unreachable address gets its share of the timeout, so the next one is still tried
+		dialCtx, dialCancel := context.WithTimeout(ctx, max(time.Until(deadline)/time.Duration(len(addrs)-i), 2*time.Second))
+		wgConn, err := w.tnet.DialContextTCPAddrPort(dialCtx, address)
+		dialCancel()
+		if err == nil {
+			return wgConn, nil
+		}
+
+		errs = append(errs, fmt.Errorf("dial %s: %w", address, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
 }
 
-func (w *Wireguard) Connect(sni string, timeout time.Duration) (net.Conn, error) {
-	address := net.JoinHostPort(sni, "443")
+// allowed drops the addresses denied by the policy, an error is returned when none is left
+func (w *Wireguard) allowed(addrs []netip.Addr, port uint16) ([]netip.Addr, error) {
+	var (
+		allowed []netip.Addr
+		denied  []error
+	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	for _, addr := range addrs {
+		if err := w.policy.CheckAddr(addr, port); err != nil {
+			denied = append(denied, err)
+			continue
+		}
+		allowed = append(allowed, addr)
+	}
 
-	wgConn, err := w.tnet.DialContext(ctx, "tcp", address)
+	if len(allowed) == 0 && len(denied) > 0 {
+		return nil, errors.Join(denied...)
+	}
+
+	return allowed, nil
+}
+
+// lookup applies the host overrides with all their addresses and resolves the rest inside the tunnel
+func (w *Wireguard) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if target, ok := w.hosts.Lookup(host); ok {
+		if len(target.Addrs) > 0 {
+			return target.Addrs, nil
+		}
+		host = target.Host
+	}
+
+	// a lookup through a peer that is down would only run into the timeout
+	if _, err := netip.ParseAddr(host); err != nil && !w.dnsReachable() {
+		return nil, fmt.Errorf("no recent wireguard handshake with the peer for the dns servers, %s is not resolved", host)
+	}
+
+	resolved, err := w.dns.LookupNetIP(ctx, host)
 	if err != nil {
-		return nil, fmt.Errorf("dial %s: %w", address, err)
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
 	}
 
-	return wgConn, nil
+	return resolved, nil
+}
+
+// dnsReachable reports whether a dns server is routed to a healthy peer, or not routed at all
+// and left to fail on its own
+func (w *Wireguard) dnsReachable() bool {
+	if len(w.dnsAddrs) == 0 {
+		return true
+	}
+
+	for _, addr := range w.dnsAddrs {
+		if peer := w.route(addr); peer == nil || peer.healthy.Load() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// route returns the peer an address is routed to
+func (w *Wireguard) route(addr netip.Addr) *wireguardPeerHealth {
+	var best *wireguardRoute
+
+	for i, route := range w.routes {
+		if route.prefix.Contains(addr) && (best == nil || route.prefix.Bits() > best.prefix.Bits()) {
+			best = &w.routes[i]
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.peer
+}
+
+// routable keeps the addresses that have a tunnel address of the same family and a healthy peer to route them to,
+// down reports addresses that were dropped because their peer has no recent handshake
+func (w *Wireguard) routable(resolved []netip.Addr) (addrs []netip.Addr, down bool) {
+	for _, addr := range resolved {
+		addr = addr.Unmap()
+
+		if (addr.Is4() && !w.hasV4) || (addr.Is6() && !w.hasV6) {
+			continue
+		}
+
+		switch peer := w.route(addr); {
+		case peer == nil:
+		case peer.healthy.Load():
+			addrs = append(addrs, addr)
+		default:
+			down = true
+		}
+	}
+
+	return addrs, down
+}
+
+// dialTunnel connects to an ip address inside the tunnel, it never resolves a name,
+// so neither the dns servers nor the destinations can be looked up outside of the tunnel
+func (w *Wireguard) dialTunnel(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("only ip addresses are dialed inside the tunnel: %w", err)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		tcpConn, err := w.tnet.DialContextTCPAddrPort(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return tcpConn, nil
+	case "udp", "udp4", "udp6":
+		udpConn, err := w.tnet.DialUDPAddrPort(netip.AddrPort{}, addr)
+		if err != nil {
+			return nil, err
+		}
+		return udpConn, nil
+	default:
+		return nil, fmt.Errorf("unsupported network: %q", network)
+	}
+}
+
+// wireguardDNSServer returns the url of a dns server inside the tunnel, plain addresses are queried over udp.
+// the server must be an ip address, resolving its name would need another dns server
+func wireguardDNSServer(server string) (string, error) {
+	if addr, err := netip.ParseAddr(server); err == nil {
+		return "udp://" + netip.AddrPortFrom(addr, 53).String(), nil
+	}
+	if addrPort, err := netip.ParseAddrPort(server); err == nil {
+		return "udp://" + addrPort.String(), nil
+	}
+
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = netip.ParseAddr(serverURL.Hostname()); err != nil {
+		return "", errors.New("the server must be an ip address")
+	}
+
+	return serverURL.String(), nil
 }
 
 func (w *Wireguard) Close() error {
+	if w.done != nil {
+		close(w.done)
+	}
 	if w.dev != nil {
 		w.dev.Close()
 	}
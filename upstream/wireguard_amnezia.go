@@ -0,0 +1,268 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	randv2 "math/rand/v2"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// wireguardAmnezia are the AmneziaWG obfuscation parameters, zero values keep plain wireguard behavior
+type wireguardAmnezia struct {
+	// Jc junk packets of Jmin to Jmax bytes are sent before every handshake initiation
+	Jc, Jmin, Jmax int
+	// S1 and S2 random bytes are prepended to handshake initiations and responses
+	S1, S2 int
+	// H1 to H4 replace the message types of initiations, responses, cookie replies and transport packets
+	H1, H2, H3, H4 uint32
+}
+
+func (a wireguardAmnezia) enabled() bool {
+	return a != wireguardAmnezia{}
+}
+
+// headers returns the message types on the wire, indexed by the wireguard message type
+func (a wireguardAmnezia) headers() [5]uint32 {
+	headers := [5]uint32{0, 1, 2, 3, 4}
+
+	for i, h := range []uint32{a.H1, a.H2, a.H3, a.H4} {
+		if h != 0 {
+			headers[i+1] = h
+		}
+	}
+
+	return headers
+}
+
+func (a wireguardAmnezia) validate() error {
+	var errs []error
+
+	if a.Jc < 0 || a.Jc > 128 {
+		errs = append(errs, fmt.Errorf("jc %d is not between 0 and 128", a.Jc))
+	}
+	if a.Jc > 0 && (a.Jmin <= 0 || a.Jmin > a.Jmax || a.Jmax > 1280) {
+		errs = append(errs, fmt.Errorf("junk size %d to %d is not within 1 to 1280", a.Jmin, a.Jmax))
+	}
+
+	if a.S1 < 0 || a.S1 > 1280-device.MessageInitiationSize {
+		errs = append(errs, fmt.Errorf("s1 %d is not between 0 and %d", a.S1, 1280-device.MessageInitiationSize))
+	}
+	if a.S2 < 0 || a.S2 > 1280-device.MessageResponseSize {
+		errs = append(errs, fmt.Errorf("s2 %d is not between 0 and %d", a.S2, 1280-device.MessageResponseSize))
+	}
+
+	// the message kind is told apart by its size
+	if device.MessageInitiationSize+a.S1 == device.MessageResponseSize+a.S2 {
+		errs = append(errs, errors.New("padded initiations and responses have the same size, s1 + 56 must not equal s2"))
+	}
+
+	headers := a.headers()
+	seen := make(map[uint32]bool)
+
+	for _, h := range headers[1:] {
+		if seen[h] {
+			errs = append(errs, fmt.Errorf("message type %d is used twice in h1 to h4", h))
+		}
+		seen[h] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// amneziaBind rewrites wireguard messages into the AmneziaWG format and back.
+// the mac1 of handshake messages covers the message type, so it is computed again
+// for the peer on the way out and checked and restored for the device on the way in
+type amneziaBind struct {
+	conn.Bind
+
+	params  wireguardAmnezia
+	headers [5]uint32
+
+	// local checks the incoming mac1 and local restores it for our own key
+	local   device.CookieChecker
+	restore device.CookieGenerator
+
+	mu sync.Mutex
+	// peers holds a cookie generator per endpoint, the cookie replies of a peer are consumed here
+	peers map[string]*device.CookieGenerator
+	// fallback is used for endpoints that are not known, like a single peer that roamed
+	fallback *device.CookieGenerator
+}
+
+func newAmneziaBind(bind conn.Bind, params wireguardAmnezia, publicKey device.NoisePublicKey) *amneziaBind {
+	b := &amneziaBind{
+		Bind:    bind,
+		params:  params,
+		headers: params.headers(),
+		peers:   make(map[string]*device.CookieGenerator),
+	}
+
+	b.local.Init(publicKey)
+	b.restore.Init(publicKey)
+
+	return b
+}
+
+// setEndpoint registers the public key of the peer at an endpoint
+func (b *amneziaBind) setEndpoint(endpoint string, publicKey device.NoisePublicKey, single bool) {
+	generator := new(device.CookieGenerator)
+	generator.Init(publicKey)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.peers[endpoint] = generator
+	if single {
+		b.fallback = generator
+	}
+}
+
+func (b *amneziaBind) generator(ep conn.Endpoint) *device.CookieGenerator {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generator, ok := b.peers[ep.DstToString()]; ok {
+		return generator
+	}
+
+	return b.fallback
+}
+
+func (b *amneziaBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	wrapped := make([]conn.ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = b.receive(fn)
+	}
+
+	return wrapped, actualPort, nil
+}
+
+func (b *amneziaBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	out := make([][]byte, 0, len(bufs))
+
+	for _, buf := range bufs {
+		if len(buf) < 4 {
+			out = append(out, buf)
+			continue
+		}
+
+		switch binary.LittleEndian.Uint32(buf) {
+		case device.MessageInitiationType:
+			if err := b.sendJunk(ep); err != nil {
+				return err
+			}
+			out = append(out, b.handshake(buf, b.params.S1, b.headers[1], ep))
+		case device.MessageResponseType:
+			out = append(out, b.handshake(buf, b.params.S2, b.headers[2], ep))
+		case device.MessageCookieReplyType:
+			binary.LittleEndian.PutUint32(buf, b.headers[3])
+			out = append(out, buf)
+		case device.MessageTransportType:
+			binary.LittleEndian.PutUint32(buf, b.headers[4])
+			out = append(out, buf)
+		default:
+			out = append(out, buf)
+		}
+	}
+
+	return b.Bind.Send(out, ep)
+}
+
+// handshake returns a padded copy of a handshake message with the amnezia type and macs for the peer
+func (b *amneziaBind) handshake(msg []byte, padding int, header uint32, ep conn.Endpoint) []byte {
+	buf := make([]byte, padding+len(msg))
+	_, _ = rand.Read(buf[:padding])
+
+	copy(buf[padding:], msg)
+	binary.LittleEndian.PutUint32(buf[padding:], header)
+
+	if generator := b.generator(ep); generator != nil {
+		generator.AddMacs(buf[padding:])
+	}
+
+	return buf
+}
+
+func (b *amneziaBind) sendJunk(ep conn.Endpoint) error {
+	for range b.params.Jc {
+		junk := make([]byte, b.params.Jmin+randv2.IntN(b.params.Jmax-b.params.Jmin+1))
+		_, _ = rand.Read(junk)
+
+		if err := b.Bind.Send([][]byte{junk}, ep); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receive restores the wireguard messages of a batch, junk and unknown packets get a size of zero so the device skips them
+func (b *amneziaBind) receive(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+
+		for i := range n {
+			sizes[i] = b.restoreMessage(packets[i][:sizes[i]], eps[i])
+		}
+
+		return n, err
+	}
+}
+
+func (b *amneziaBind) restoreMessage(packet []byte, ep conn.Endpoint) int {
+	header := func(offset int) uint32 { return binary.LittleEndian.Uint32(packet[offset:]) }
+
+	switch size := len(packet); {
+	case size == device.MessageInitiationSize+b.params.S1 && header(b.params.S1) == b.headers[1]:
+		return b.restoreHandshake(packet, b.params.S1, device.MessageInitiationType)
+	case size == device.MessageResponseSize+b.params.S2 && header(b.params.S2) == b.headers[2]:
+		return b.restoreHandshake(packet, b.params.S2, device.MessageResponseType)
+	case size == device.MessageCookieReplySize && header(0) == b.headers[3]:
+		b.consumeCookieReply(packet, ep)
+		return 0
+	case size >= device.MessageTransportSize && header(0) == b.headers[4]:
+		binary.LittleEndian.PutUint32(packet, device.MessageTransportType)
+		return size
+	default:
+		return 0
+	}
+}
+
+func (b *amneziaBind) restoreHandshake(packet []byte, padding int, msgType uint32) int {
+	msg := packet[padding:]
+	if !b.local.CheckMAC1(msg) {
+		return 0
+	}
+
+	binary.LittleEndian.PutUint32(msg, msgType)
+	b.restore.AddMacs(msg)
+
+	return copy(packet, msg)
+}
+
+// consumeCookieReply hands the cookie to the generator of the peer, it was encrypted for the mac1
+// of the amnezia message, which the device never saw, so the device does not get the reply
+func (b *amneziaBind) consumeCookieReply(packet []byte, ep conn.Endpoint) {
+	generator := b.generator(ep)
+	if generator == nil {
+		return
+	}
+
+	var reply device.MessageCookieReply
+	if err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &reply); err != nil {
+		return
+	}
+
+	generator.ConsumeReply(&reply)
+}
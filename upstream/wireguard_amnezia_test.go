@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+var testAmnezia = wireguardAmnezia{Jc: 3, Jmin: 40, Jmax: 70, S1: 15, S2: 68, H1: 1106457265, H2: 249455488, H3: 1209847463, H4: 1646644382}
+
+// amneziaClient returns an upstream with the amnezia parameters, talking to the server at endpoint
+func amneziaClient(t *testing.T, endpoint string, serverKey device.NoisePublicKey) (*Wireguard, device.NoisePublicKey) {
+	t.Helper()
+
+	interfaceLines := fmt.Sprintf("Jc = %d\nJmin = %d\nJmax = %d\nS1 = %d\nS2 = %d\nH1 = %d\nH2 = %d\nH3 = %d\nH4 = %d\n",
+		testAmnezia.Jc, testAmnezia.Jmin, testAmnezia.Jmax, testAmnezia.S1, testAmnezia.S2,
+		testAmnezia.H1, testAmnezia.H2, testAmnezia.H3, testAmnezia.H4)
+
+	return wireguardClient(t, endpoint, serverKey, interfaceLines, config.WireguardConfig{Transport: config.WireguardTransportUDP})
+}
+
+func TestWireguardAmnezia(t *testing.T) {
+	serverPrivateKey, serverPublicKey := testWireguardKey(t)
+	bind := newAmneziaBind(conn.NewDefaultBind(), testAmnezia, serverPublicKey)
+
+	port, allow := wireguardServer(t, serverPrivateKey, bind)
+
+	w, clientPublicKey := amneziaClient(t, "127.0.0.1:"+port, serverPublicKey)
+
+	// the server learns the client endpoint from the handshake
+	bind.setEndpoint("", clientPublicKey, true)
+	allow(clientPublicKey)
+
+	conn, err := w.Connect("10.8.0.1", 443, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Connect() error: %v", err)
+	}
+	defer conn.Close()
+
+	wireguardEcho(t, conn)
+}
+
+func TestWireguardAmneziaWireFormat(t *testing.T) {
+	_, serverPublicKey := testWireguardKey(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	w, _ := amneziaClient(t, pc.LocalAddr().String(), serverPublicKey)
+
+	// the connect attempt starts a handshake, nobody answers it
+	go func() { _, _ = w.Connect("10.8.0.1", 443, time.Second) }()
+
+	if err = pc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := make([]byte, 2048)
+
+	for i := range testAmnezia.Jc {
+		n, _, err := pc.ReadFrom(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < testAmnezia.Jmin || n > testAmnezia.Jmax {
+			t.Errorf("junk packet %d has %d bytes, want %d to %d", i, n, testAmnezia.Jmin, testAmnezia.Jmax)
+		}
+	}
+
+	n, _, err := pc.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != device.MessageInitiationSize+testAmnezia.S1 {
+		t.Fatalf("initiation has %d bytes, want: %d", n, device.MessageInitiationSize+testAmnezia.S1)
+	}
+
+	msg := packet[testAmnezia.S1:n]
+	if header := binary.LittleEndian.Uint32(msg); header != testAmnezia.H1 {
+		t.Errorf("got message type %d, want: %d", header, testAmnezia.H1)
+	}
+
+	// an amneziawg server checks the mac1 over the message with its own type
+	var checker device.CookieChecker
+	checker.Init(serverPublicKey)
+
+	if !checker.CheckMAC1(msg) {
+		t.Error("mac1 does not match the amnezia message")
+	}
+}
+
+func TestWireguardAmneziaValidate(t *testing.T) {
+	for _, params := range []wireguardAmnezia{
+		{Jc: 200, Jmin: 10, Jmax: 20},
+		{Jc: 3, Jmin: 50, Jmax: 20},
+		{S1: 10, S2: 66},
+		{H1: 5, H2: 5, H3: 6, H4: 7},
+		{H1: 2},
+	} {
+		if err := params.validate(); err == nil {
+			t.Errorf("%+v: expected error", params)
+		}
+	}
+
+	if err := testAmnezia.validate(); err != nil {
+		t.Errorf("validate() error: %v", err)
+	}
+}
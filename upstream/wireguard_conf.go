@@ -0,0 +1,233 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.capy.fun/sni-proxy/config"
+)
+
+// wireguardSettings is the device configuration, taken from the env variables or a wg-quick file
+type wireguardSettings struct {
+	PrivateKey string
+	Addresses  []string
+	DNS        []string
+	MTU        int
+	ListenPort int
+	FwMark     int
+	Amnezia    wireguardAmnezia
+	Peers      []wireguardPeer
+}
+
+type wireguardPeer struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// wgQuickDirectives are handled by wg-quick on the host, they have no meaning for the netstack device
+var wgQuickDirectives = map[string]bool{
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+}
+
+// wireguardSettingsFromEnv maps the single peer env variables onto the device configuration
+func wireguardSettingsFromEnv(cfg config.WireguardConfig) wireguardSettings {
+	settings := wireguardSettings{
+		PrivateKey: cfg.PrivateKey,
+		Addresses:  cfg.TunnelIP,
+		MTU:        cfg.MTU,
+		Amnezia: wireguardAmnezia{
+			Jc: cfg.Jc, Jmin: cfg.Jmin, Jmax: cfg.Jmax,
+			S1: cfg.S1, S2: cfg.S2,
+			H1: cfg.H1, H2: cfg.H2, H3: cfg.H3, H4: cfg.H4,
+		},
+		Peers: []wireguardPeer{{
+			PublicKey:           cfg.PublicKey,
+			PresharedKey:        cfg.PresharedKey,
+			Endpoint:            cfg.Endpoint,
+			AllowedIPs:          cfg.AllowedIPs,
+			PersistentKeepalive: cfg.KeepaliveInterval,
+		}},
+	}
+
+	if len(cfg.AllowedIPs) == 0 {
+		settings.Peers[0].AllowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	if settings.Peers[0].PersistentKeepalive == 0 {
+		settings.Peers[0].PersistentKeepalive = 25
+	}
+
+	settings.DNS = cfg.DNS
+
+	return settings
+}
+
+// loadWireguardConf reads a wg-quick file from a path, or decodes it from inline base64
+func loadWireguardConf(source string) ([]byte, error) {
+	data, err := os.ReadFile(source)
+	if err == nil {
+		return data, nil
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+		if data, decodeErr := encoding.DecodeString(strings.TrimSpace(source)); decodeErr == nil {
+			return data, nil
+		}
+	}
+
+	// not base64 either, so it was meant to be a path
+	return nil, err
+}
+
+// parseWireguardConf parses the [Interface] and [Peer] sections of a wg-quick file,
+// directives that can not be applied are returned as warnings
+func parseWireguardConf(data []byte) (wireguardSettings, []string, error) {
+	var settings wireguardSettings
+	var warnings []string
+	var errs []error
+
+	var section string
+	var peer *wireguardPeer
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+
+			switch section {
+			case "interface":
+			case "peer":
+				settings.Peers = append(settings.Peers, wireguardPeer{})
+				peer = &settings.Peers[len(settings.Peers)-1]
+			default:
+				warnings = append(warnings, fmt.Sprintf("line %d: ignoring unknown section [%s]", n, section))
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			errs = append(errs, fmt.Errorf("line %d: expected key = value", n))
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+
+		switch {
+		case section == "":
+			errs = append(errs, fmt.Errorf("line %d: %s is outside of a section", n, key))
+		case section == "interface" && key == "privatekey":
+			settings.PrivateKey = value
+		case section == "interface" && key == "address":
+			settings.Addresses = append(settings.Addresses, splitList(value)...)
+		case section == "interface" && key == "dns":
+			for _, server := range splitList(value) {
+				// wg-quick treats entries that are no ip address as search domains
+				if _, err := netip.ParseAddr(server); err != nil {
+					warnings = append(warnings, fmt.Sprintf("line %d: ignoring dns search domain %s", n, server))
+					continue
+				}
+				settings.DNS = append(settings.DNS, server)
+			}
+		case section == "interface" && key == "mtu":
+			settings.MTU, err = strconv.Atoi(value)
+		case section == "interface" && key == "listenport":
+			settings.ListenPort, err = strconv.Atoi(value)
+		case section == "interface" && key == "fwmark":
+			if value != "off" {
+				var mark uint64
+				mark, err = strconv.ParseUint(value, 0, 32)
+				settings.FwMark = int(mark)
+			}
+		case section == "interface" && key == "jc":
+			settings.Amnezia.Jc, err = strconv.Atoi(value)
+		case section == "interface" && key == "jmin":
+			settings.Amnezia.Jmin, err = strconv.Atoi(value)
+		case section == "interface" && key == "jmax":
+			settings.Amnezia.Jmax, err = strconv.Atoi(value)
+		case section == "interface" && key == "s1":
+			settings.Amnezia.S1, err = strconv.Atoi(value)
+		case section == "interface" && key == "s2":
+			settings.Amnezia.S2, err = strconv.Atoi(value)
+		case section == "interface" && key == "h1":
+			settings.Amnezia.H1, err = parseUint32(value)
+		case section == "interface" && key == "h2":
+			settings.Amnezia.H2, err = parseUint32(value)
+		case section == "interface" && key == "h3":
+			settings.Amnezia.H3, err = parseUint32(value)
+		case section == "interface" && key == "h4":
+			settings.Amnezia.H4, err = parseUint32(value)
+		case section == "interface" && wgQuickDirectives[key]:
+			warnings = append(warnings, fmt.Sprintf("line %d: ignoring unsupported wg-quick directive %s", n, key))
+		case section == "peer" && key == "publickey":
+			peer.PublicKey = value
+		case section == "peer" && key == "presharedkey":
+			peer.PresharedKey = value
+		case section == "peer" && key == "endpoint":
+			peer.Endpoint = value
+		case section == "peer" && key == "allowedips":
+			peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+		case section == "peer" && key == "persistentkeepalive":
+			if value != "off" {
+				peer.PersistentKeepalive, err = strconv.Atoi(value)
+			}
+		case section == "interface" || section == "peer":
+			warnings = append(warnings, fmt.Sprintf("line %d: ignoring unknown directive %s", n, key))
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid %s: %w", n, key, err))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return settings, warnings, err
+	}
+
+	if len(settings.Peers) == 0 {
+		errs = append(errs, errors.New("no [Peer] section"))
+	}
+
+	return settings, warnings, errors.Join(errs...)
+}
+
+// splitList splits a comma separated wg-quick value
+func splitList(value string) []string {
+	var items []string
+
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func parseUint32(value string) (uint32, error) {
+	v, err := strconv.ParseUint(value, 10, 32)
+
+	return uint32(v), err
+}
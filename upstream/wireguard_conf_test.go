@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testWireguardConf = `# exported by the vpn provider
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/32, fd00::2/128
+DNS = 10.8.0.1, vpn.internal
+MTU = 1380
+FwMark = 0x20
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 15
+`
+
+func TestParseWireguardConf(t *testing.T) {
+	settings, warnings, err := parseWireguardConf([]byte(testWireguardConf))
+	if err != nil {
+		t.Fatalf("parseWireguardConf() error: %v", err)
+	}
+
+	expected := wireguardSettings{
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		Addresses:  []string{"10.8.0.2/32", "fd00::2/128"},
+		DNS:        []string{"10.8.0.1"},
+		MTU:        1380,
+		FwMark:     0x20,
+		Peers: []wireguardPeer{{
+			PublicKey:           "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+			PresharedKey:        "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+			Endpoint:            "vpn.example.com:51820",
+			AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+			PersistentKeepalive: 15,
+		}},
+	}
+
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("got %+v, want: %+v", settings, expected)
+	}
+
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "vpn.internal") || !strings.Contains(warnings[1], "postup") {
+		t.Errorf("got warnings %q, want the search domain and postup", warnings)
+	}
+}
+
+func TestParseWireguardConfErrors(t *testing.T) {
+	for _, conf := range []string{
+		"PrivateKey = abc\n[Peer]\n",
+		"[Interface]\nMTU = large\n[Peer]\n",
+		"[Interface]\nPrivateKey\n[Peer]\n",
+		"[Interface]\nPrivateKey = abc\n",
+	} {
+		if _, _, err := parseWireguardConf([]byte(conf)); err == nil {
+			t.Errorf("%q: expected error", conf)
+		}
+	}
+}
+
+func TestLoadWireguardConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte(testWireguardConf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{path, base64.StdEncoding.EncodeToString([]byte(testWireguardConf))} {
+		data, err := loadWireguardConf(source)
+		if err != nil {
+			t.Fatalf("loadWireguardConf() error: %v", err)
+		}
+		if string(data) != testWireguardConf {
+			t.Errorf("got %q, want the config file", data)
+		}
+	}
+
+	if _, err := loadWireguardConf("/nonexistent/wg0.conf"); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
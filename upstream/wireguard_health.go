@@ -0,0 +1,266 @@
+package upstream
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// wireguardStaleAfter is the reject-after-time of the protocol, older sessions can not carry traffic
+const wireguardStaleAfter = device.RejectAfterTime
+
+// wireguardHandshakeTimeout is how long handshake initiations may go unanswered, the device
+// sends one every 5 seconds, so a peer is down after three of them
+const wireguardHandshakeTimeout = 3 * device.RekeyTimeout
+
+// wireguardProbeKeepalive turns on the persistent keepalive of a peer without one for a moment,
+// the device sends a keepalive right away, which starts a handshake
+const wireguardProbeKeepalive = 25
+
+// wireguardPeerHealth follows the handshakes of a peer
+type wireguardPeerHealth struct {
+	publicKey string
+	endpoint  string
+	keepalive int
+
+	healthy atomic.Bool
+
+	// only used by the monitor: txBytes as of the last check, when the device started
+	// sending without a session, and the address of the endpoint last handed to the device
+	txBytes      uint64
+	pendingSince time.Time
+	address      netip.AddrPort
+}
+
+// wireguardPeerStatus is the state of a peer as reported by the device
+type wireguardPeerStatus struct {
+	endpoint      string
+	lastHandshake time.Time
+	rxBytes       uint64
+	txBytes       uint64
+}
+
+// observe reports whether the peer has a session, and whether it is stale: without a session
+// every packet starts with a handshake initiation, they went unanswered for too long.
+// an idle peer is neither, it has no reason to handshake
+func (p *wireguardPeerHealth) observe(status wireguardPeerStatus, now time.Time) (session, stale bool) {
+	session = !status.lastHandshake.IsZero() && now.Sub(status.lastHandshake) <= wireguardStaleAfter
+
+	switch {
+	case session:
+		p.pendingSince = time.Time{}
+	case status.txBytes > p.txBytes && p.pendingSince.IsZero():
+		p.pendingSince = now
+	}
+	p.txBytes = status.txBytes
+
+	unanswered := !p.pendingSince.IsZero() && now.Sub(p.pendingSince) > wireguardHandshakeTimeout
+
+	// the endpoint could not be resolved yet, nothing is sent without one
+	return session, status.endpoint == "" || (!session && unanswered)
+}
+
+func (w *Wireguard) monitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.checkHealth(time.Now())
+		}
+	}
+}
+
+// checkHealth marks peers with unanswered handshakes as down, moves them to the next address
+// of their endpoint and starts a new handshake, a dynamic dns name may point to a new address by now
+func (w *Wireguard) checkHealth(now time.Time) {
+	ipc, err := w.dev.IpcGet()
+	if err != nil {
+		slog.Warn("failed to read wireguard device state", slog.Any("error", err))
+		return
+	}
+
+	statuses := parseWireguardStatus(ipc)
+
+	for _, peer := range w.peers {
+		status := statuses[peer.publicKey]
+		session, stale := peer.observe(status, now)
+
+		slog.Debug("wireguard peer",
+			slog.String("endpoint", peer.endpoint),
+			slog.String("address", status.endpoint),
+			slog.Time("last_handshake", status.lastHandshake),
+			slog.Uint64("rx_bytes", status.rxBytes),
+			slog.Uint64("tx_bytes", status.txBytes),
+		)
+
+		if session {
+			if !peer.healthy.Swap(true) {
+				slog.Info("wireguard peer is up", slog.String("endpoint", peer.endpoint), slog.Time("last_handshake", status.lastHandshake))
+			}
+			continue
+		}
+
+		// an idle peer or one with a handshake in progress keeps its state
+		if !stale {
+			continue
+		}
+
+		if peer.healthy.Swap(false) {
+			slog.Warn("wireguard peer is down, handshakes are unanswered",
+				slog.String("endpoint", peer.endpoint),
+				slog.Time("last_handshake", status.lastHandshake),
+			)
+		}
+
+		if err = w.updateEndpoint(peer, true); err != nil {
+			slog.Warn("failed to resolve wireguard endpoint", slog.String("endpoint", peer.endpoint), slog.Any("error", err))
+			continue
+		}
+
+		// connections are not routed to a peer that is down, so nothing else would start a handshake
+		if err = w.probe(peer); err != nil {
+			slog.Warn("failed to start wireguard handshake", slog.String("endpoint", peer.endpoint), slog.Any("error", err))
+		}
+		peer.pendingSince = now
+	}
+}
+
+// updateEndpoint resolves the endpoint of a peer and hands an address to the device when it changed,
+// with rotate the next address of the endpoint is taken, the current one may be unreachable
+func (w *Wireguard) updateEndpoint(peer *wireguardPeerHealth, rotate bool) error {
+	host, port, err := net.SplitHostPort(peer.endpoint)
+	if err != nil {
+		return err
+	}
+
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := w.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return errors.New("no addresses")
+	}
+
+	next := 0
+	if i := slices.Index(addrs, peer.address.Addr()); i >= 0 {
+		next = i
+		if rotate {
+			next = (i + 1) % len(addrs)
+		}
+	}
+
+	addr := netip.AddrPortFrom(addrs[next].Unmap(), uint16(portNum))
+	if addr == peer.address {
+		return nil
+	}
+
+	if w.stream != nil {
+		w.stream.setHost(addr, host)
+	}
+
+	// the amnezia bind has to know the peer before the first handshake goes out
+	if w.amnezia != nil {
+		var publicKey device.NoisePublicKey
+		if err = publicKey.FromHex(peer.publicKey); err != nil {
+			return err
+		}
+		w.amnezia.setEndpoint(addr.String(), publicKey, len(w.peers) == 1)
+	}
+
+	if err = w.dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peer.publicKey, addr)); err != nil {
+		return fmt.Errorf("device IpcSet: %w", err)
+	}
+
+	if peer.address.IsValid() {
+		slog.Info("wireguard endpoint changed", slog.String("endpoint", peer.endpoint), slog.String("address", addr.String()))
+	}
+	peer.address = addr
+
+	return nil
+}
+
+// probe makes the device send a keepalive to the peer, which starts a handshake without a session.
+// the device only sends one when the persistent keepalive is turned on, so it is turned off and on again
+func (w *Wireguard) probe(peer *wireguardPeerHealth) error {
+	var ipc strings.Builder
+
+	fmt.Fprintf(&ipc, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=0\n", peer.publicKey)
+	fmt.Fprintf(&ipc, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=%d\n", peer.publicKey, cmp.Or(peer.keepalive, wireguardProbeKeepalive))
+	if peer.keepalive == 0 {
+		fmt.Fprintf(&ipc, "public_key=%s\nupdate_only=true\npersistent_keepalive_interval=0\n", peer.publicKey)
+	}
+
+	if err := w.dev.IpcSet(ipc.String()); err != nil {
+		return fmt.Errorf("device IpcSet: %w", err)
+	}
+
+	return nil
+}
+
+// parseWireguardStatus reads the peers of a uapi get response, keyed by their hex public key
+func parseWireguardStatus(ipc string) map[string]wireguardPeerStatus {
+	statuses := make(map[string]wireguardPeerStatus)
+
+	var publicKey string
+	var status wireguardPeerStatus
+	var sec, nsec int64
+
+	flush := func() {
+		if publicKey == "" {
+			return
+		}
+		if sec != 0 || nsec != 0 {
+			status.lastHandshake = time.Unix(sec, nsec)
+		}
+		statuses[publicKey] = status
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(ipc))
+
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+
+		switch key {
+		case "public_key":
+			flush()
+			publicKey, status, sec, nsec = value, wireguardPeerStatus{}, 0, 0
+		case "endpoint":
+			status.endpoint = value
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			status.rxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			status.txBytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	flush()
+
+	return statuses
+}
@@ -0,0 +1,367 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	utls "github.com/refraction-networking/utls"
+	"golang.zx2c4.com/wireguard/conn"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// wireguardStreamTimeout limits dialing a stream, the device retries the handshake after a failure
+const wireguardStreamTimeout = 10 * time.Second
+
+// datagramStream carries wireguard datagrams over a stream connection
+type datagramStream interface {
+	ReadDatagram() ([]byte, error)
+	WriteDatagram(b []byte) error
+	Close() error
+}
+
+// lengthPrefixedStream frames every datagram with its size as 16 bit big endian
+type lengthPrefixedStream struct {
+	conn net.Conn
+}
+
+func (s *lengthPrefixedStream) ReadDatagram() ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(s.conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(s.conn, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s *lengthPrefixedStream) WriteDatagram(b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	_, err := s.conn.Write(frame)
+
+	return err
+}
+
+func (s *lengthPrefixedStream) Close() error {
+	return s.conn.Close()
+}
+
+// webSocketStream sends every datagram as a binary message
+type webSocketStream struct {
+	conn *websocket.Conn
+	// the device sends from several goroutines, a websocket takes one writer at a time
+	mu sync.Mutex
+}
+
+func (s *webSocketStream) ReadDatagram() ([]byte, error) {
+	for {
+		messageType, b, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType == websocket.BinaryMessage {
+			return b, nil
+		}
+	}
+}
+
+func (s *webSocketStream) WriteDatagram(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (s *webSocketStream) Close() error {
+	return s.conn.Close()
+}
+
+// streamDialer opens the stream to an endpoint, with tls and a websocket upgrade when configured
+type streamDialer struct {
+	transport config.WireguardTransport
+	outbound  *dialer.Outbound
+	path      string
+
+	// tlsConfig is nil without tls, the server name defaults to the host of the endpoint
+	tlsConfig   *tls.Config
+	fingerprint *utls.ClientHelloID
+}
+
+func (d *streamDialer) dial(addr netip.AddrPort, host string) (datagramStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wireguardStreamTimeout)
+	defer cancel()
+
+	tcpConn, err := d.outbound.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := host
+	if d.tlsConfig != nil && d.tlsConfig.ServerName != "" {
+		serverName = d.tlsConfig.ServerName
+	}
+
+	var c net.Conn = tcpConn
+
+	if d.tlsConfig != nil {
+		tlsConfig := d.tlsConfig.Clone()
+		tlsConfig.ServerName = serverName
+
+		if c, err = tlsHandshake(ctx, tcpConn, tlsConfig, d.fingerprint); err != nil {
+			tcpConn.Close()
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+	}
+
+	if d.transport != config.WireguardTransportWebSocket {
+		return &lengthPrefixedStream{conn: c}, nil
+	}
+
+	// the connection is ready, tls included, so the websocket dialer only does the upgrade
+	wsDialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) { return c, nil },
+	}
+
+	u := url.URL{Scheme: "ws", Host: net.JoinHostPort(serverName, strconv.Itoa(int(addr.Port()))), Path: d.path}
+
+	wsConn, resp, err := wsDialer.DialContext(ctx, u.String(), http.Header{})
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: %w", err)
+	}
+
+	return &webSocketStream{conn: wsConn}, nil
+}
+
+type streamDatagram struct {
+	b  []byte
+	ep conn.Endpoint
+}
+
+// streamBind is a conn.Bind that sends the datagrams of the device over one stream per endpoint,
+// a stream is dialed on the first send and again after it broke
+type streamBind struct {
+	dialer *streamDialer
+
+	mu       sync.Mutex
+	streams  map[netip.AddrPort]datagramStream
+	dials    map[netip.AddrPort]*streamDial
+	hosts    map[netip.AddrPort]string
+	incoming chan streamDatagram
+	closed   chan struct{}
+}
+
+// streamDial is a stream being dialed, other sends to the endpoint wait for it
+type streamDial struct {
+	done chan struct{}
+
+	stream datagramStream
+	err    error
+}
+
+func newStreamBind(dialer *streamDialer) *streamBind {
+	return &streamBind{
+		dialer:  dialer,
+		streams: make(map[netip.AddrPort]datagramStream),
+		dials:   make(map[netip.AddrPort]*streamDial),
+		hosts:   make(map[netip.AddrPort]string),
+	}
+}
+
+// setHost remembers the hostname of an endpoint for the tls server name
+func (b *streamBind) setHost(addr netip.AddrPort, host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.hosts[addr] = host
+}
+
+func (b *streamBind) Open(_ uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.incoming != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	incoming := make(chan streamDatagram, 64)
+	closed := make(chan struct{})
+
+	b.incoming = incoming
+	b.closed = closed
+
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case d := <-incoming:
+			sizes[0] = copy(packets[0], d.b)
+			eps[0] = d.ep
+			return 1, nil
+		}
+	}
+
+	return []conn.ReceiveFunc{receive}, 0, nil
+}
+
+func (b *streamBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.incoming == nil {
+		return nil
+	}
+
+	close(b.closed)
+	b.incoming = nil
+
+	for addr, stream := range b.streams {
+		_ = stream.Close()
+		delete(b.streams, addr)
+	}
+
+	return nil
+}
+
+// SetMark is a no-op, the streams are dialed with the outbound options
+func (*streamBind) SetMark(_ uint32) error { return nil }
+
+func (*streamBind) BatchSize() int { return 1 }
+
+func (*streamBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn.StdNetEndpoint{AddrPort: addr}, nil
+}
+
+func (b *streamBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	addr, err := netip.ParseAddrPort(ep.DstToString())
+	if err != nil {
+		return err
+	}
+
+	stream, err := b.stream(addr, ep)
+	if err != nil {
+		return err
+	}
+
+	for _, buf := range bufs {
+		if err = stream.WriteDatagram(buf); err != nil {
+			b.drop(addr, stream)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stream returns the stream to an endpoint, dialing it when there is none
+func (b *streamBind) stream(addr netip.AddrPort, ep conn.Endpoint) (datagramStream, error) {
+	b.mu.Lock()
+
+	if b.incoming == nil {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+
+	if stream, ok := b.streams[addr]; ok {
+		b.mu.Unlock()
+		return stream, nil
+	}
+
+	if d, ok := b.dials[addr]; ok {
+		b.mu.Unlock()
+		<-d.done
+		return d.stream, d.err
+	}
+
+	host, ok := b.hosts[addr]
+	if !ok {
+		host = addr.Addr().String()
+	}
+
+	d := &streamDial{done: make(chan struct{})}
+	b.dials[addr] = d
+	incoming, closed := b.incoming, b.closed
+	b.mu.Unlock()
+
+	// the dial can take as long as wireguardStreamTimeout, sends to other endpoints are not held up by it
+	d.stream, d.err = b.dialer.dial(addr, host)
+
+	b.mu.Lock()
+	delete(b.dials, addr)
+	switch {
+	case d.err != nil:
+		d.err = fmt.Errorf("failed to connect to %s: %w", addr, d.err)
+	case b.closed != closed || b.incoming == nil:
+		// the bind was closed during the dial
+		_ = d.stream.Close()
+		d.stream, d.err = nil, net.ErrClosed
+	default:
+		b.streams[addr] = d.stream
+		go b.read(addr, ep, d.stream, incoming, closed)
+	}
+	b.mu.Unlock()
+
+	close(d.done)
+
+	return d.stream, d.err
+}
+
+func (b *streamBind) read(addr netip.AddrPort, ep conn.Endpoint, stream datagramStream, incoming chan<- streamDatagram, closed <-chan struct{}) {
+	defer b.drop(addr, stream)
+
+	for {
+		datagram, err := stream.ReadDatagram()
+		if err != nil {
+			return
+		}
+
+		select {
+		case incoming <- streamDatagram{b: datagram, ep: ep}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// drop closes a broken stream, the next send dials a new one
+func (b *streamBind) drop(addr netip.AddrPort, stream datagramStream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.streams[addr] == stream {
+		delete(b.streams, addr)
+	}
+
+	_ = stream.Close()
+}
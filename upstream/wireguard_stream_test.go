@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.zx2c4.com/wireguard/conn"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+// relayDatagrams forwards datagrams between a stream and the udp port of a wireguard server,
+// like a relay in front of it
+func relayDatagrams(stream datagramStream, port string) {
+	defer stream.Close()
+
+	udpConn, err := net.Dial("udp", "127.0.0.1:"+port)
+	if err != nil {
+		return
+	}
+	defer udpConn.Close()
+
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, err := udpConn.Read(b)
+			if err != nil {
+				return
+			}
+			if err = stream.WriteDatagram(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		b, err := stream.ReadDatagram()
+		if err != nil {
+			return
+		}
+		if _, err = udpConn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// streamRelay listens for the stream transport and returns its address and certificate pool
+func streamRelay(t *testing.T, transport config.WireguardTransport, withTLS bool, port string) (string, *x509.CertPool) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	cert, pool := testCertificate(t, "wg.test")
+	if withTLS {
+		// like a cdn, which offers h2 to the clients that ask for it
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}})
+	}
+
+	if transport == config.WireguardTransportWebSocket {
+		var upgrader websocket.Upgrader
+
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/wg" {
+				http.NotFound(w, r)
+				return
+			}
+
+			// the upgrade only exists in http/1.1
+			if r.TLS != nil && r.TLS.NegotiatedProtocol != "http/1.1" {
+				http.Error(w, "alpn "+r.TLS.NegotiatedProtocol, http.StatusBadRequest)
+				return
+			}
+
+			wsConn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			relayDatagrams(&webSocketStream{conn: wsConn}, port)
+		})}
+
+		go func() { _ = srv.Serve(ln) }()
+
+		return ln.Addr().String(), pool
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go relayDatagrams(&lengthPrefixedStream{conn: c}, port)
+		}
+	}()
+
+	return ln.Addr().String(), pool
+}
+
+func TestWireguardStream(t *testing.T) {
+	for _, tc := range []struct {
+		transport   config.WireguardTransport
+		tls         bool
+		fingerprint string
+	}{
+		{config.WireguardTransportTCP, false, ""},
+		{config.WireguardTransportTCP, true, ""},
+		{config.WireguardTransportTCP, true, "chrome"},
+		{config.WireguardTransportWebSocket, false, ""},
+		{config.WireguardTransportWebSocket, true, ""},
+		// the preset offers h2, which would break the upgrade
+		{config.WireguardTransportWebSocket, true, "chrome"},
+	} {
+		serverPrivateKey, serverPublicKey := testWireguardKey(t)
+		port, allow := wireguardServer(t, serverPrivateKey, conn.NewDefaultBind())
+
+		address, pool := streamRelay(t, tc.transport, tc.tls, port)
+
+		cfg := config.WireguardConfig{Transport: tc.transport, TLS: tc.tls, Fingerprint: tc.fingerprint, Path: "/wg"}
+		if tc.tls {
+			cfg.ServerName = "wg.test"
+		}
+
+		w, clientPublicKey := wireguardClient(t, address, serverPublicKey, "", cfg)
+		if tc.tls {
+			w.stream.dialer.tlsConfig.RootCAs = pool
+		}
+		allow(clientPublicKey)
+
+		conn, err := w.Connect("10.8.0.1", 443, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s tls %v fingerprint %q: Connect() error: %v", tc.transport, tc.tls, tc.fingerprint, err)
+		}
+
+		wireguardEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestStreamBindConcurrentDial(t *testing.T) {
+	cert, pool := testCertificate(t, "wg.test")
+
+	// the tls handshake with the silent relay hangs until its connection is closed
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = silent.Close() })
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	relay, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = relay.Close() })
+
+	go func() {
+		for {
+			c, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, c) }()
+		}
+	}()
+
+	bind := newStreamBind(&streamDialer{
+		transport: config.WireguardTransportTCP,
+		outbound:  dialer.NewOutbound(config.OutboundConfig{}),
+		tlsConfig: &tls.Config{ServerName: "wg.test", RootCAs: pool},
+	})
+	if _, _, err = bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	send := func(address string) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			ep, err := bind.ParseEndpoint(address)
+			if err == nil {
+				err = bind.Send([][]byte{[]byte("datagram")}, ep)
+			}
+			errs <- err
+		}()
+		return errs
+	}
+
+	// both sends to the silent relay wait for the same dial
+	hanging := []<-chan error{send(silent.Addr().String()), send(silent.Addr().String())}
+	silentConn := <-accepted
+
+	// a send to another endpoint is not held up by the hanging dial
+	select {
+	case err = <-send(relay.Addr().String()):
+		if err != nil {
+			t.Errorf("Send() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send waited for the dial to another endpoint")
+	}
+
+	_ = silentConn.Close()
+
+	for _, errs := range hanging {
+		select {
+		case err = <-errs:
+			if err == nil {
+				t.Error("expected error from the silent relay")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("send did not return after the relay closed the connection")
+		}
+	}
+
+	if len(accepted) != 0 {
+		t.Errorf("got %d more connections to the silent relay, want: 1 dial", len(accepted))
+	}
+}
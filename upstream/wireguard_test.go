@@ -0,0 +1,657 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+
+	"git.capy.fun/sni-proxy/config"
+	"git.capy.fun/sni-proxy/dialer"
+)
+
+const testWireguardPeers = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.8.0.2/32, fd00::2/128
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 192.0.2.0/24, 2001:db8::/32
+
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+Endpoint = localhost:51821
+AllowedIPs = %s
+`
+
+func newTestWireguard(t *testing.T, allowedIPs string) *Wireguard {
+	conf := strings.Replace(testWireguardPeers, "%s", allowedIPs, 1)
+
+	return NewWireguard(config.WireguardConfig{
+		Config:    base64.StdEncoding.EncodeToString([]byte(conf)),
+		Transport: config.WireguardTransportUDP,
+		// the dns server is routed to the first peer
+		DNS: []string{"192.0.2.53"},
+	}, dialer.NewOutbound(config.OutboundConfig{}), testResolver(t), dialer.NewHosts(nil), testPolicy(t, true))
+}
+
+// testPolicy returns an initialized destination policy, the test tunnel only has private addresses
+func testPolicy(t *testing.T, allowPrivate bool) *dialer.Policy {
+	t.Helper()
+
+	policy := dialer.NewPolicy(config.PolicyConfig{AllowPrivate: allowPrivate}, "127.0.0.1:8443")
+	if err := policy.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return policy
+}
+
+// testEndpoints are the names the test resolver knows, endpoints are resolved outside of the tunnel
+var testEndpoints = map[string][]net.IP{
+	"localhost.":  {net.IPv4(127, 0, 0, 1)},
+	"multi.test.": {net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)},
+}
+
+// testResolver returns a resolver for testEndpoints, answered by a dns server on the loopback
+func testResolver(t *testing.T) *dialer.Resolver {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+
+		question := msg.Question[0]
+		ips, ok := testEndpoints[question.Name]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+
+		for _, ip := range ips {
+			if question.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   ip,
+				})
+			}
+		}
+
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	resolver := dialer.NewResolver(config.ResolverConfig{
+		Servers: []string{"udp://" + pc.LocalAddr().String()},
+		Timeout: 5 * time.Second,
+	}, new(net.Dialer).DialContext)
+	if err = resolver.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return resolver
+}
+
+func TestWireguardRoutable(t *testing.T) {
+	w := newTestWireguard(t, "198.51.100.0/24")
+	if err := w.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	defer w.Close()
+
+	var resolved []netip.Addr
+	for _, s := range []string{"2001:db8::1", "2a00::1", "192.0.2.1", "198.51.100.7", "203.0.113.1", "::ffff:192.0.2.9"} {
+		resolved = append(resolved, netip.MustParseAddr(s))
+	}
+
+	addrs, _ := w.routable(resolved)
+
+	expected := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("198.51.100.7"),
+		netip.MustParseAddr("192.0.2.9"),
+	}
+
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("got %v, want: %v", addrs, expected)
+	}
+}
+
+func TestWireguardSamePrefix(t *testing.T) {
+	err := newTestWireguard(t, "192.0.2.0/24").Validate()
+	if err == nil || !strings.Contains(err.Error(), "allowed ip 192.0.2.0/24 is already routed to peer 1") {
+		t.Errorf("got error %v, want the same allowed ip on two peers", err)
+	}
+}
+
+func TestWireguardNestedAllowedIPs(t *testing.T) {
+	// the second peer takes a part of the first one's range and everything else
+	w := newTestWireguard(t, "192.0.2.128/25, 0.0.0.0/0")
+	if err := w.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	defer w.Close()
+
+	for addr, peer := range map[string]int{
+		"192.0.2.1":   0,
+		"192.0.2.200": 1,
+		"203.0.113.1": 1,
+		"2001:db8::1": 0,
+	} {
+		if got := w.route(netip.MustParseAddr(addr)); got != w.peers[peer] {
+			t.Errorf("%s: routed to peer %d, want: %d", addr, slices.Index(w.peers, got)+1, peer+1)
+		}
+	}
+}
+
+func TestWireguardValidateThenInit(t *testing.T) {
+	w := newTestWireguard(t, "198.51.100.0/24")
+
+	// validating leaves nothing behind that Init would add to
+	for range 2 {
+		if err := w.Validate(); err != nil {
+			t.Fatalf("Validate() error: %v", err)
+		}
+	}
+	if len(w.routes) != 0 || len(w.peers) != 0 {
+		t.Errorf("Validate() kept %d routes and %d peers", len(w.routes), len(w.peers))
+	}
+
+	if err := w.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	defer w.Close()
+
+	if len(w.routes) != 3 || len(w.peers) != 2 {
+		t.Errorf("got %d routes and %d peers, want: 3 and 2", len(w.routes), len(w.peers))
+	}
+}
+
+func TestWireguardHealth(t *testing.T) {
+	w := newTestWireguard(t, "198.51.100.0/24")
+	if err := w.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	defer w.Close()
+
+	ipc, err := w.dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hostname endpoint is resolved before it is handed to the device
+	for _, peer := range w.peers {
+		if status := parseWireguardStatus(ipc)[peer.publicKey]; status.endpoint == "" {
+			t.Errorf("peer %s has no endpoint", peer.endpoint)
+		}
+	}
+
+	// nothing answers at the endpoint, so the handshake initiations stay unanswered
+	if _, err = w.Connect("192.0.2.1", 443, 500*time.Millisecond); err == nil {
+		t.Fatal("expected error")
+	}
+
+	now := time.Now()
+
+	// the device keeps sending initiations for a while before the peer is down
+	w.checkHealth(now)
+	if !w.peers[0].healthy.Load() {
+		t.Error("peer is down before its handshake timed out")
+	}
+
+	w.checkHealth(now.Add(wireguardHandshakeTimeout + time.Second))
+
+	if w.peers[0].healthy.Load() {
+		t.Error("peer without handshake is healthy")
+	}
+	if !w.peers[1].healthy.Load() {
+		t.Error("idle peer is not healthy")
+	}
+
+	start := time.Now()
+	_, err = w.Connect("192.0.2.1", 443, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "no recent wireguard handshake") {
+		t.Errorf("got error %v, want: no recent wireguard handshake", err)
+	}
+
+	// the dns server is behind the peer that is down
+	_, err = w.Connect("example.com", 443, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "peer for the dns servers") {
+		t.Errorf("got error %v, want: no recent wireguard handshake with the peer for the dns servers", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Connect() took %s, want it to fail fast", elapsed)
+	}
+
+	// the probe turned the persistent keepalive back off
+	if ipc, err = w.dev.IpcGet(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ipc, "persistent_keepalive_interval=25") {
+		t.Error("persistent keepalive is still on after the probe")
+	}
+}
+
+func TestWireguardPeerObserve(t *testing.T) {
+	peer := &wireguardPeerHealth{}
+	now := time.Now()
+	lastHandshake := now.Add(-time.Hour)
+
+	status := wireguardPeerStatus{endpoint: "127.0.0.1:51820", lastHandshake: lastHandshake, txBytes: 100}
+	peer.txBytes = 100
+
+	// an idle peer without keepalives lets its session expire, that says nothing about its health
+	for i := range 3 {
+		if session, stale := peer.observe(status, now.Add(time.Duration(i)*time.Minute)); session || stale {
+			t.Errorf("idle peer: got session %v, stale %v, want neither", session, stale)
+		}
+	}
+
+	// sending without a session starts handshake initiations
+	status.txBytes = 248
+	if _, stale := peer.observe(status, now); stale {
+		t.Error("peer is stale as soon as it started a handshake")
+	}
+
+	status.txBytes = 400
+	if _, stale := peer.observe(status, now.Add(wireguardHandshakeTimeout/2)); stale {
+		t.Error("peer is stale before its handshake timed out")
+	}
+	if _, stale := peer.observe(status, now.Add(wireguardHandshakeTimeout+time.Second)); !stale {
+		t.Error("peer with unanswered handshakes is not stale")
+	}
+
+	// a handshake ends the pending one
+	status.lastHandshake = now.Add(wireguardHandshakeTimeout)
+	if session, stale := peer.observe(status, now.Add(wireguardHandshakeTimeout+2*time.Second)); !session || stale {
+		t.Errorf("got session %v, stale %v after a handshake, want a session", session, stale)
+	}
+	if !peer.pendingSince.IsZero() {
+		t.Error("pending handshake was not cleared")
+	}
+
+	if _, stale := peer.observe(wireguardPeerStatus{}, now); !stale {
+		t.Error("peer without endpoint is not stale")
+	}
+}
+
+func TestWireguardEndpointRotation(t *testing.T) {
+	_, serverPublicKey := testWireguardKey(t)
+
+	// nothing listens at either address of the endpoint
+	w, _ := wireguardClient(t, "multi.test:51820", serverPublicKey, "", config.WireguardConfig{Transport: config.WireguardTransportUDP})
+	peer := w.peers[0]
+
+	endpoint := func() string {
+		t.Helper()
+
+		ipc, err := w.dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parseWireguardStatus(ipc)[peer.publicKey].endpoint
+	}
+
+	if got := endpoint(); got != "127.0.0.2:51820" {
+		t.Fatalf("got endpoint %s, want: 127.0.0.2:51820", got)
+	}
+
+	if _, err := w.Connect("10.8.0.1", 443, 500*time.Millisecond); err == nil {
+		t.Fatal("expected error")
+	}
+
+	now := time.Now()
+	w.checkHealth(now)
+	w.checkHealth(now.Add(wireguardHandshakeTimeout + time.Second))
+
+	// the unreachable address is replaced by the next one
+	if got := endpoint(); got != "127.0.0.3:51820" {
+		t.Errorf("got endpoint %s, want: 127.0.0.3:51820", got)
+	}
+
+	if err := w.updateEndpoint(peer, true); err != nil {
+		t.Fatalf("updateEndpoint() error: %v", err)
+	}
+	if got := endpoint(); got != "127.0.0.2:51820" {
+		t.Errorf("got endpoint %s, want: 127.0.0.2:51820", got)
+	}
+}
+
+func TestWireguardDNS(t *testing.T) {
+	for _, servers := range [][]string{
+		{"10.8.0.1"},
+		{"tcp://10.8.0.1"},
+		{"tls://10.8.0.1"},
+		{"https://10.8.0.1:8443/dns-query"},
+		// the first server refuses the connection, the second one answers
+		{"tcp://10.8.0.1:5353", "udp://10.8.0.1:53"},
+	} {
+		serverPrivateKey, serverPublicKey := testWireguardKey(t)
+		port, allow := wireguardServer(t, serverPrivateKey, conn.NewDefaultBind())
+
+		cfg := config.WireguardConfig{Transport: config.WireguardTransportUDP, DNS: servers, DNSServerName: tunnelDNSServerName}
+
+		w, clientPublicKey := wireguardClient(t, "127.0.0.1:"+port, serverPublicKey, "DNS = 192.0.2.53", cfg)
+		allow(clientPublicKey)
+
+		// echo.test only exists inside the tunnel
+		conn, err := w.Connect("echo.test", 443, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%v: Connect() error: %v", servers, err)
+		}
+
+		wireguardEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestWireguardHosts(t *testing.T) {
+	serverPrivateKey, serverPublicKey := testWireguardKey(t)
+	port, allow := wireguardServer(t, serverPrivateKey, conn.NewDefaultBind())
+
+	cfg := config.WireguardConfig{Transport: config.WireguardTransportUDP, DNS: []string{"10.8.0.1"}}
+
+	w, clientPublicKey := wireguardClient(t, "127.0.0.1:"+port, serverPublicKey, "", cfg)
+	allow(clientPublicKey)
+
+	// the tunnel dns server only knows echo.test, 10.8.0.9 does not answer
+	w.hosts = dialer.NewHosts([]string{"static.test=10.8.0.9;10.8.0.1", "*.alias.test=echo.test"})
+	if err := w.hosts.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"static.test", "www.alias.test"} {
+		conn, err := w.Connect(host, 443, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: Connect() error: %v", host, err)
+		}
+
+		wireguardEcho(t, conn)
+		conn.Close()
+	}
+
+	if _, err := w.Connect("unknown.test", 443, 5*time.Second); err == nil {
+		t.Error("expected error for a name the tunnel dns server does not know")
+	}
+}
+
+func TestWireguardPolicy(t *testing.T) {
+	serverPrivateKey, serverPublicKey := testWireguardKey(t)
+	port, allow := wireguardServer(t, serverPrivateKey, conn.NewDefaultBind())
+
+	cfg := config.WireguardConfig{Transport: config.WireguardTransportUDP, DNS: []string{"10.8.0.1"}}
+
+	w, clientPublicKey := wireguardClient(t, "127.0.0.1:"+port, serverPublicKey, "", cfg)
+	allow(clientPublicKey)
+
+	w.policy = testPolicy(t, false)
+	w.hosts = dialer.NewHosts([]string{"static.test=10.8.0.1"})
+	if err := w.hosts.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the names pass the suffix check, their addresses inside the tunnel do not
+	for _, host := range []string{"echo.test", "loop.test", "static.test", "10.8.0.1"} {
+		if _, err := w.Connect(host, 443, 5*time.Second); err == nil || !strings.Contains(err.Error(), "denied by policy") {
+			t.Errorf("%s: got error %v, want a policy denial", host, err)
+		}
+	}
+}
+
+func TestWireguardDNSServer(t *testing.T) {
+	for server, expected := range map[string]string{
+		"10.8.0.1":              "udp://10.8.0.1:53",
+		"[fd00::1]:5353":        "udp://[fd00::1]:5353",
+		"tls://1.1.1.1":         "tls://1.1.1.1",
+		"https://[fd00::1]/dns": "https://[fd00::1]/dns",
+	} {
+		if got, err := wireguardDNSServer(server); err != nil || got != expected {
+			t.Errorf("%s: got %q, %v, want: %q", server, got, err, expected)
+		}
+	}
+
+	// a name would have to be resolved outside of the tunnel
+	for _, server := range []string{"dns.example", "tls://dns.example:853"} {
+		if _, err := wireguardDNSServer(server); err == nil {
+			t.Errorf("%s: expected error", server)
+		}
+	}
+}
+
+func TestParseWireguardStatus(t *testing.T) {
+	ipc := "private_key=aa\nlisten_port=51820\n" +
+		"public_key=01\nendpoint=[2001:db8::1]:51820\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=5\ntx_bytes=100\nrx_bytes=200\n" +
+		"public_key=02\nlast_handshake_time_sec=0\nlast_handshake_time_nsec=0\ntx_bytes=0\nrx_bytes=0\n"
+
+	expected := map[string]wireguardPeerStatus{
+		"01": {endpoint: "[2001:db8::1]:51820", lastHandshake: time.Unix(1700000000, 5), rxBytes: 200, txBytes: 100},
+		"02": {},
+	}
+
+	if statuses := parseWireguardStatus(ipc); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got %+v, want: %+v", statuses, expected)
+	}
+}
+
+func testWireguardKey(t *testing.T) ([]byte, device.NoisePublicKey) {
+	t.Helper()
+
+	privateKey := make([]byte, 32)
+	_, _ = rand.Read(privateKey)
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey, device.NoisePublicKey(publicKey)
+}
+
+// wireguardServer runs a device with an echo server at 10.8.0.1:443 and a dns server at 10.8.0.1:53
+// inside the tunnel, it returns the udp port and a function that adds a client as peer
+func wireguardServer(t *testing.T, privateKey []byte, bind conn.Bind) (string, func(device.NoisePublicKey)) {
+	t.Helper()
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.8.0.1")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := device.NewDevice(tunDev, bind, device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(server.Close)
+
+	if err = server.IpcSet("private_key=" + hex.EncodeToString(privateKey) + "\nlisten_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	ipc, err := server.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := strings.Cut(ipc[strings.Index(ipc, "listen_port="):], "=")
+	port, _, _ = strings.Cut(port, "\n")
+
+	ln, err := tnet.ListenTCP(&net.TCPAddr{IP: net.IPv4(10, 8, 0, 1), Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tunnelDNS(t, tnet)
+
+	allow := func(publicKey device.NoisePublicKey) {
+		if err := server.IpcSet("public_key=" + hex.EncodeToString(publicKey[:]) + "\nallowed_ip=10.8.0.2/32\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return port, allow
+}
+
+// tunnelDNS answers echo.test with 10.8.0.1 over udp and tcp inside the tunnel
+func tunnelDNS(t *testing.T, tnet *netstack.Net) {
+	t.Helper()
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		_ = w.WriteMsg(tunnelDNSAnswer(msg))
+	})
+
+	pc, err := tnet.ListenUDPAddrPort(netip.MustParseAddrPort("10.8.0.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.8.0.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn, err := tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.8.0.1:853"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsLn, err := tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.8.0.1:8443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{tunnelDNSCertificate}}
+
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	tlsServer := &dns.Server{Listener: tls.NewListener(tlsLn, tlsConfig), Handler: handler}
+	httpsServer := &http.Server{Handler: http.HandlerFunc(tunnelDoH), TLSConfig: tlsConfig}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	go func() { _ = tlsServer.ActivateAndServe() }()
+	go func() { _ = httpsServer.ServeTLS(httpsLn, "", "") }()
+	t.Cleanup(func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+		_ = tlsServer.Shutdown()
+		_ = httpsServer.Close()
+	})
+}
+
+// tunnelDNSAnswer resolves echo.test to the echo server of the tunnel and loop.test to the loopback
+func tunnelDNSAnswer(msg *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+
+	addrs := map[string]net.IP{
+		"echo.test.": net.IPv4(10, 8, 0, 1),
+		"loop.test.": net.IPv4(127, 0, 0, 1),
+	}
+
+	switch question := msg.Question[0]; {
+	case addrs[question.Name] == nil:
+		resp.Rcode = dns.RcodeNameError
+	case question.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   addrs[question.Name],
+		})
+	}
+
+	return resp
+}
+
+// tunnelDoH answers dns-over-https posts with tunnelDNSAnswer
+func tunnelDoH(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err = msg.Unpack(body); err != nil || len(msg.Question) == 0 {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	packed, err := tunnelDNSAnswer(msg).Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(packed)
+}
+
+// wireguardClient returns an initialized upstream for the server at endpoint, interfaceLines are added to its config file
+func wireguardClient(t *testing.T, endpoint string, serverKey device.NoisePublicKey, interfaceLines string, cfg config.WireguardConfig) (*Wireguard, device.NoisePublicKey) {
+	t.Helper()
+
+	privateKey, publicKey := testWireguardKey(t)
+
+	conf := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = 10.8.0.2/32\n%s\n[Peer]\nPublicKey = %s\nEndpoint = %s\nAllowedIPs = 10.8.0.0/24\n",
+		base64.StdEncoding.EncodeToString(privateKey), interfaceLines, base64.StdEncoding.EncodeToString(serverKey[:]), endpoint)
+
+	cfg.Config = base64.StdEncoding.EncodeToString([]byte(conf))
+
+	w := NewWireguard(cfg, dialer.NewOutbound(config.OutboundConfig{}), testResolver(t), dialer.NewHosts(nil), testPolicy(t, true))
+	if err := w.Init(); err != nil {
+		t.Fatalf("Init() error: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+
+	return w, publicKey
+}
+
+func wireguardEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("got %q, want: %q", reply, "ping")
+	}
+}